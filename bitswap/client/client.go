@@ -66,6 +66,28 @@ func SetSimulateDontHavesOnTimeout(send bool) Option {
 	}
 }
 
+// ProviderSearchRetry makes sessions retry provider searches that find no
+// providers, backing off exponentially from initialDelay up to maxDelay,
+// for at most maxAttempts retries. By default searches are not retried.
+func ProviderSearchRetry(initialDelay, maxDelay time.Duration, maxAttempts int) Option {
+	return func(bs *Client) {
+		bs.providerSearchRetry = bssession.ProviderSearchRetry{
+			InitialDelay: initialDelay,
+			MaxDelay:     maxDelay,
+			MaxAttempts:  maxAttempts,
+		}
+	}
+}
+
+// MaxPeersPerSession limits how many peers a single session keeps track of
+// at once, bounding connection manager tagging churn against large swarms.
+// Zero (the default) means no limit.
+func MaxPeersPerSession(n int) Option {
+	return func(bs *Client) {
+		bs.maxPeersPerSession = n
+	}
+}
+
 // Configures the Client to use given tracer.
 // This provides methods to access all messages sent and received by the Client.
 // This interface can be used to implement various statistics (this is original intent).
@@ -135,10 +157,14 @@ func New(parent context.Context, network bsnet.BitSwapNetwork, bstore blockstore
 		provSearchDelay time.Duration,
 		rebroadcastDelay delay.D,
 		self peer.ID) bssm.Session {
-		return bssession.New(sessctx, sessmgr, id, spm, pqm, sim, pm, bpm, notif, provSearchDelay, rebroadcastDelay, self)
+		session := bssession.New(sessctx, sessmgr, id, spm, pqm, sim, pm, bpm, notif, provSearchDelay, rebroadcastDelay, self)
+		session.SetProviderSearchRetry(bs.providerSearchRetry)
+		return session
 	}
 	sessionPeerManagerFactory := func(ctx context.Context, id uint64) bssession.SessionPeerManager {
-		return bsspm.New(id, network.ConnectionManager())
+		spm := bsspm.New(id, network.ConnectionManager())
+		spm.SetMaxPeers(bs.maxPeersPerSession)
+		return spm
 	}
 	notif := notifications.New()
 	sm = bssm.New(ctx, sessionFactory, sim, sessionPeerManagerFactory, bpm, pm, notif, network.Self())
@@ -223,10 +249,16 @@ type Client struct {
 	// how often to rebroadcast providing requests to find more optimized providers
 	rebroadcastDelay delay.D
 
+	// how sessions retry provider searches that found nothing
+	providerSearchRetry bssession.ProviderSearchRetry
+
 	blockReceivedNotifier BlockReceivedNotifier
 
 	// whether we should actually simulate dont haves on request timeout
 	simulateDontHavesOnTimeout bool
+
+	// maximum number of peers tracked by a session, zero means no limit
+	maxPeersPerSession int
 }
 
 type counters struct {
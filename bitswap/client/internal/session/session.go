@@ -2,6 +2,7 @@ package session
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
@@ -125,6 +126,13 @@ type Session struct {
 	consecutiveTicks    int
 	initialSearchDelay  time.Duration
 	periodicSearchDelay delay.D
+
+	// retry policy for provider searches that find nothing, and the CIDs
+	// with a search that is still being retried
+	retryLk       sync.Mutex
+	providerRetry ProviderSearchRetry
+	retrying      map[cid.Cid]struct{}
+
 	// identifiers
 	notif notifications.PubSub
 	id    uint64
@@ -264,6 +272,27 @@ func (s *Session) SetBaseTickDelay(baseTickDelay time.Duration) {
 	}
 }
 
+// ProviderSearchRetry configures how a session retries a provider search
+// that found no providers. The delay between attempts starts at
+// InitialDelay and doubles after each attempt, up to MaxDelay.
+// MaxAttempts is the number of retries after the first search; zero
+// disables retrying. While a search for a CID is being retried, further
+// searches for it are skipped.
+type ProviderSearchRetry struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	MaxAttempts  int
+}
+
+// SetProviderSearchRetry changes how provider searches that find nothing
+// are retried.
+func (s *Session) SetProviderSearchRetry(retry ProviderSearchRetry) {
+	s.retryLk.Lock()
+	defer s.retryLk.Unlock()
+
+	s.providerRetry = retry
+}
+
 // onWantsSent is called when wants are sent to a peer by the session wants sender
 func (s *Session) onWantsSent(p peer.ID, wantBlocks []cid.Cid, wantHaves []cid.Cid) {
 	allBlks := append(wantBlocks[:len(wantBlocks):len(wantBlocks)], wantHaves...)
@@ -389,11 +418,60 @@ func (s *Session) handlePeriodicSearch(ctx context.Context) {
 // findMorePeers attempts to find more peers for a session by searching for
 // providers for the given Cid
 func (s *Session) findMorePeers(ctx context.Context, c cid.Cid) {
+	s.retryLk.Lock()
+	retry := s.providerRetry
+	if retry.MaxAttempts > 0 {
+		// findMorePeers is called on every idle tick and periodic search,
+		// don't pile up backoff chains for a CID that is already searched for
+		if _, ok := s.retrying[c]; ok {
+			s.retryLk.Unlock()
+			return
+		}
+		if s.retrying == nil {
+			s.retrying = make(map[cid.Cid]struct{})
+		}
+		s.retrying[c] = struct{}{}
+	}
+	s.retryLk.Unlock()
+
 	go func(k cid.Cid) {
-		for p := range s.providerFinder.FindProvidersAsync(ctx, k) {
-			// When a provider indicates that it has a cid, it's equivalent to
-			// the providing peer sending a HAVE
-			s.sws.Update(p, nil, []cid.Cid{c}, nil)
+		if retry.MaxAttempts > 0 {
+			defer func() {
+				s.retryLk.Lock()
+				delete(s.retrying, k)
+				s.retryLk.Unlock()
+			}()
+		}
+
+		delay := retry.InitialDelay
+		for attempt := 0; ; attempt++ {
+			found := false
+			for p := range s.providerFinder.FindProvidersAsync(ctx, k) {
+				found = true
+				// When a provider indicates that it has a cid, it's equivalent to
+				// the providing peer sending a HAVE
+				s.sws.Update(p, nil, []cid.Cid{c}, nil)
+			}
+			if found || attempt >= retry.MaxAttempts {
+				return
+			}
+
+			// Nothing found, back off and search again
+			log.Debugw("no providers found, retrying", "session", s.id, "cid", k, "attempt", attempt+1, "delay", delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-s.ctx.Done():
+				timer.Stop()
+				return
+			}
+			delay *= 2
+			if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+				delay = retry.MaxDelay
+			}
 		}
 	}(c)
 }
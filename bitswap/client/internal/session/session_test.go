@@ -321,6 +321,62 @@ func TestSessionFindMorePeers(t *testing.T) {
 	}
 }
 
+type emptyProviderFinder struct {
+	lk    sync.Mutex
+	calls int
+}
+
+func (epf *emptyProviderFinder) FindProvidersAsync(ctx context.Context, k cid.Cid) <-chan peer.ID {
+	epf.lk.Lock()
+	defer epf.lk.Unlock()
+	epf.calls++
+
+	ch := make(chan peer.ID)
+	close(ch)
+	return ch
+}
+
+func (epf *emptyProviderFinder) callCount() int {
+	epf.lk.Lock()
+	defer epf.lk.Unlock()
+	return epf.calls
+}
+
+func TestSessionFindMorePeersRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fpm := newFakePeerManager()
+	fspm := newFakeSessionPeerManager()
+	epf := &emptyProviderFinder{}
+	sim := bssim.New()
+	bpm := bsbpm.New()
+	notif := notifications.New()
+	defer notif.Shutdown()
+	id := testutil.GenerateSessionID()
+	sm := newMockSessionMgr()
+	session := New(ctx, sm, id, fspm, epf, sim, fpm, bpm, notif, time.Minute, delay.Fixed(time.Minute), "")
+	session.SetProviderSearchRetry(ProviderSearchRetry{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     4 * time.Millisecond,
+		MaxAttempts:  3,
+	})
+
+	c := testutil.GenerateCids(1)[0]
+	session.findMorePeers(ctx, c)
+	// A search for the same CID while the first one is retrying is skipped
+	session.findMorePeers(ctx, c)
+
+	// The first search plus three retries
+	deadline := time.Now().Add(time.Second)
+	for epf.callCount() < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if calls := epf.callCount(); calls != 4 {
+		t.Fatalf("expected 4 provider searches, got %d", calls)
+	}
+}
+
 func TestSessionOnPeersExhausted(t *testing.T) {
 	test.Flaky(t)
 
@@ -1,6 +1,7 @@
 package sessionpeermanager
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 
@@ -35,6 +36,12 @@ type SessionPeerManager struct {
 	plk             sync.RWMutex
 	peers           map[peer.ID]struct{}
 	peersDiscovered bool
+
+	// maximum number of peers tracked at once, zero means no limit
+	maxPeers int
+
+	// set once Shutdown has untagged the peers
+	shutdown bool
 }
 
 // New creates a new SessionPeerManager
@@ -47,17 +54,37 @@ func New(id uint64, tagger PeerTagger) *SessionPeerManager {
 	}
 }
 
+// SetMaxPeers limits the number of peers the SessionPeerManager tracks at
+// once. Once the limit is reached new peers are refused until existing ones
+// are removed. Zero means no limit.
+func (spm *SessionPeerManager) SetMaxPeers(n int) {
+	spm.plk.Lock()
+	defer spm.plk.Unlock()
+
+	spm.maxPeers = n
+}
+
 // AddPeer adds the peer to the SessionPeerManager.
-// Returns true if the peer is a new peer, false if it already existed.
+// Returns true if the peer is a new peer, false if it already existed, the
+// SessionPeerManager is full or it was shut down.
 func (spm *SessionPeerManager) AddPeer(p peer.ID) bool {
 	spm.plk.Lock()
 	defer spm.plk.Unlock()
 
+	if spm.shutdown {
+		return false
+	}
+
 	// Check if the peer is a new peer
 	if _, ok := spm.peers[p]; ok {
 		return false
 	}
 
+	if spm.maxPeers > 0 && len(spm.peers) >= spm.maxPeers {
+		log.Debugw("Bitswap: session full, not adding peer", "session", spm.id, "peer", p, "maxPeers", spm.maxPeers)
+		return false
+	}
+
 	spm.peers[p] = struct{}{}
 	spm.peersDiscovered = true
 
@@ -136,11 +163,86 @@ func (spm *SessionPeerManager) HasPeer(p peer.ID) bool {
 	return ok
 }
 
-// Shutdown untags all the peers
+// stateVersion is the version of the serialization produced by ExportState.
+const stateVersion = 1
+
+// ExportState serializes the peers of the session, so that another
+// SessionPeerManager can be seeded with them using ImportState. The first
+// byte is the version of the format, followed by the number of peers and each
+// peer ID prefixed with its length, as unsigned varints.
+func (spm *SessionPeerManager) ExportState() []byte {
+	spm.plk.RLock()
+	defer spm.plk.RUnlock()
+
+	state := []byte{stateVersion}
+	state = binary.AppendUvarint(state, uint64(len(spm.peers)))
+	for p := range spm.peers {
+		state = binary.AppendUvarint(state, uint64(len(p)))
+		state = append(state, p...)
+	}
+	return state
+}
+
+// ImportState adds the peers from a state returned by ExportState to the
+// SessionPeerManager, as AddPeer would. Nothing is added if the state is
+// malformed, of an unknown version or holds an invalid peer ID. An error is
+// also returned if some of the peers were refused because the
+// SessionPeerManager is full or shut down; the others are kept.
+func (spm *SessionPeerManager) ImportState(state []byte) error {
+	if len(state) == 0 || state[0] != stateVersion {
+		return fmt.Errorf("unsupported session state version")
+	}
+	rest := state[1:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return fmt.Errorf("malformed session state")
+	}
+	rest = rest[n:]
+
+	var peers []peer.ID
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < size {
+			return fmt.Errorf("malformed session state")
+		}
+		rest = rest[n:]
+		if size == 0 {
+			return fmt.Errorf("malformed session state: empty peer ID")
+		}
+		p, err := peer.IDFromBytes(rest[:size])
+		if err != nil {
+			return fmt.Errorf("malformed session state: %w", err)
+		}
+		peers = append(peers, p)
+		rest = rest[size:]
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("malformed session state")
+	}
+
+	refused := 0
+	for _, p := range peers {
+		if !spm.AddPeer(p) && !spm.HasPeer(p) {
+			refused++
+		}
+	}
+	if refused > 0 {
+		return fmt.Errorf("%d of %d imported peers refused: session is full or shut down", refused, len(peers))
+	}
+	return nil
+}
+
+// Shutdown untags all the peers. Peers are no longer added afterwards, and
+// calling it again does nothing.
 func (spm *SessionPeerManager) Shutdown() {
 	spm.plk.Lock()
 	defer spm.plk.Unlock()
 
+	if spm.shutdown {
+		return
+	}
+	spm.shutdown = true
+
 	// Untag the peers with the ConnectionManager so that it can release
 	// connections to those peers
 	for p := range spm.peers {
@@ -148,3 +250,9 @@ func (spm *SessionPeerManager) Shutdown() {
 		spm.tagger.Unprotect(p, spm.tag)
 	}
 }
+
+// Close stops the SessionPeerManager like Shutdown: it untags and unprotects
+// all the peers before returning. It is safe to call more than once.
+func (spm *SessionPeerManager) Close() {
+	spm.Shutdown()
+}
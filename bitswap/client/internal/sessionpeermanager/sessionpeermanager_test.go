@@ -7,6 +7,7 @@ import (
 	"github.com/ipfs/go-libipfs/bitswap/internal/testutil"
 	"github.com/ipfs/go-libipfs/internal/test"
 	peer "github.com/libp2p/go-libp2p/core/peer"
+	libp2ptest "github.com/libp2p/go-libp2p/core/test"
 )
 
 type fakePeerTagger struct {
@@ -128,6 +129,83 @@ func TestRemovePeers(t *testing.T) {
 	}
 }
 
+func TestMaxPeers(t *testing.T) {
+	peers := testutil.GeneratePeers(3)
+	fpt := newFakePeerTagger()
+	spm := New(1, fpt)
+	spm.SetMaxPeers(2)
+
+	spm.AddPeer(peers[0])
+	spm.AddPeer(peers[1])
+	if spm.AddPeer(peers[2]) {
+		t.Fatal("Expected peer not to be added to a full session")
+	}
+	if spm.HasPeer(peers[2]) {
+		t.Fatal("Expected refused peer not to be tracked")
+	}
+	if len(fpt.taggedPeers) != 2 {
+		t.Fatal("Expected refused peer not to be tagged")
+	}
+
+	// Removing a peer makes room for a new one
+	spm.RemovePeer(peers[0])
+	if !spm.AddPeer(peers[2]) {
+		t.Fatal("Expected peer to be added once there is room")
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	// imported peer IDs are validated, so they must be real ones
+	var peers []peer.ID
+	for i := 0; i < 3; i++ {
+		peers = append(peers, libp2ptest.RandPeerIDFatal(t))
+	}
+	spm := New(1, newFakePeerTagger())
+	for _, p := range peers {
+		spm.AddPeer(p)
+	}
+	state := spm.ExportState()
+
+	fpt := newFakePeerTagger()
+	restored := New(2, fpt)
+	if err := restored.ImportState(state); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range peers {
+		if !restored.HasPeer(p) {
+			t.Fatal("Expected imported peer to be tracked")
+		}
+	}
+	if len(fpt.taggedPeers) != len(peers) {
+		t.Fatal("Expected imported peers to be tagged")
+	}
+
+	// Unknown versions, truncated states and invalid peer IDs are refused as
+	// a whole
+	unknown := append([]byte{0xff}, state[1:]...)
+	emptyID := append(append([]byte{stateVersion, 4}, state[2:]...), 0)
+	invalidID := append(append([]byte{stateVersion, 4}, state[2:]...), 3, 'f', 'o', 'o')
+	for _, bad := range [][]byte{nil, unknown, state[:len(state)-1], emptyID, invalidID} {
+		empty := New(3, newFakePeerTagger())
+		if err := empty.ImportState(bad); err == nil {
+			t.Fatal("Expected malformed state to be refused")
+		}
+		if empty.HasPeers() {
+			t.Fatal("Expected no peers to be imported from a malformed state")
+		}
+	}
+
+	// Peers that do not fit are reported
+	full := New(4, newFakePeerTagger())
+	full.SetMaxPeers(2)
+	if err := full.ImportState(state); err == nil {
+		t.Fatal("Expected an error when peers are refused")
+	}
+	if len(full.Peers()) != 2 {
+		t.Fatal("Expected the peers that fit to be imported")
+	}
+}
+
 func TestHasPeers(t *testing.T) {
 	test.Flaky(t)
 
@@ -319,3 +397,33 @@ func TestShutdown(t *testing.T) {
 		t.Fatal("Expected to have unprotected all peers")
 	}
 }
+
+func TestClose(t *testing.T) {
+	peers := testutil.GeneratePeers(3)
+	fpt := newFakePeerTagger()
+	spm := New(1, fpt)
+
+	spm.AddPeer(peers[0])
+	spm.AddPeer(peers[1])
+	spm.ProtectConnection(peers[0])
+
+	spm.Close()
+
+	if len(fpt.taggedPeers) != 0 {
+		t.Fatal("Expected to have untagged all peers")
+	}
+	if len(fpt.protectedPeers) != 0 {
+		t.Fatal("Expected to have unprotected all peers")
+	}
+
+	// the fake tagger panics if peers are untagged more than once
+	spm.Close()
+	spm.Shutdown()
+
+	if spm.AddPeer(peers[2]) {
+		t.Fatal("Expected not to add peers after close")
+	}
+	if len(fpt.taggedPeers) != 0 {
+		t.Fatal("Expected no peers to be tagged after close")
+	}
+}
@@ -79,6 +79,14 @@ func SetSimulateDontHavesOnTimeout(send bool) Option {
 	return Option{client.SetSimulateDontHavesOnTimeout(send)}
 }
 
+func ProviderSearchRetry(initialDelay, maxDelay time.Duration, maxAttempts int) Option {
+	return Option{client.ProviderSearchRetry(initialDelay, maxDelay, maxAttempts)}
+}
+
+func MaxPeersPerSession(n int) Option {
+	return Option{client.MaxPeersPerSession(n)}
+}
+
 func WithTracer(tap tracer.Tracer) Option {
 	// Only trace the server, both receive the same messages anyway
 	return Option{
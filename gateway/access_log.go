@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+)
+
+// AccessLogEntry describes a GET or HEAD request served by the gateway, for
+// Config.AccessLog.
+type AccessLogEntry struct {
+	Method string
+	Path   string
+	// Format is the media type of the response format, empty when the
+	// request failed before one was selected.
+	Format   string
+	Status   int
+	Duration time.Duration
+
+	// Proto is the protocol of the connection, e.g. "HTTP/1.1" or "HTTP/2.0".
+	Proto string
+	// TLSVersion and TLSCipherSuite describe the TLS connection, and are zero
+	// when the request did not use TLS. Use tls.CipherSuiteName for a
+	// readable cipher suite name.
+	TLSVersion     uint16
+	TLSCipherSuite uint16
+}
+
+// connectionLogFields returns the connection metadata of r as key-value
+// pairs for structured logging.
+func connectionLogFields(r *http.Request) []interface{} {
+	fields := []interface{}{"proto", r.Proto}
+	if r.TLS != nil {
+		fields = append(fields, "tls_version", r.TLS.Version, "tls_cipher_suite", r.TLS.CipherSuite)
+	}
+	return fields
+}
+
+// logAccess passes the request to Config.AccessLog.
+func (i *handler) logAccess(r *http.Request, status int, begin time.Time) {
+	if status == 0 {
+		// nothing was written, so net/http sends an empty 200
+		status = http.StatusOK
+	}
+	format, _ := r.Context().Value(responseFormatKey).(responseFormat)
+	entry := AccessLogEntry{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Format:   format.mediaType,
+		Status:   status,
+		Duration: i.since(begin),
+		Proto:    r.Proto,
+	}
+	if r.TLS != nil {
+		entry.TLSVersion = r.TLS.Version
+		entry.TLSCipherSuite = r.TLS.CipherSuite
+	}
+	i.config.AccessLog(entry)
+}
@@ -114,6 +114,18 @@ type DagTemplateData struct {
 	CodecHex  string
 }
 
+// DefaultListingStrings are the English texts of the directory listing, by
+// the keys DirectoryTemplateData.Text looks them up with.
+var DefaultListingStrings = map[string]string{
+	"about-ipfs":      "About IPFS",
+	"install-ipfs":    "Install IPFS",
+	"about":           "About",
+	"install":         "Install",
+	"report-bug":      "Report a bug",
+	"index-of":        "Index of",
+	"cumulative-size": "Cumulative size of IPFS DAG (data + metadata)",
+}
+
 type DirectoryTemplateData struct {
 	GatewayURL  string
 	DNSLink     bool
@@ -123,6 +135,19 @@ type DirectoryTemplateData struct {
 	Breadcrumbs []Breadcrumb
 	BackLink    string
 	Hash        string
+	// Lang is the language of the listing, English when empty
+	Lang string
+	// Strings replaces DefaultListingStrings, by key
+	Strings map[string]string
+}
+
+// Text returns the text of the listing for key, from Strings or else from
+// DefaultListingStrings.
+func (d DirectoryTemplateData) Text(key string) string {
+	if s, ok := d.Strings[key]; ok {
+		return s
+	}
+	return DefaultListingStrings[key]
 }
 
 type DirectoryItem struct {
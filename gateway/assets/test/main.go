@@ -140,6 +140,25 @@ type DirectoryTemplateData struct {
 	Breadcrumbs []Breadcrumb
 	BackLink    string
 	Hash        string
+	Lang        string
+	Strings     map[string]string
+}
+
+func (d DirectoryTemplateData) Text(key string) string {
+	if s, ok := d.Strings[key]; ok {
+		return s
+	}
+	return defaultListingStrings[key]
+}
+
+var defaultListingStrings = map[string]string{
+	"about-ipfs":      "About IPFS",
+	"install-ipfs":    "Install IPFS",
+	"about":           "About",
+	"install":         "Install",
+	"report-bug":      "Report a bug",
+	"index-of":        "Index of",
+	"cumulative-size": "Cumulative size of IPFS DAG (data + metadata)",
 }
 
 type DirectoryItem struct {
@@ -0,0 +1,58 @@
+package gateway
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIP returns the address of the client that sent r. When the request
+// came through one of trustedProxies, the X-Forwarded-For header is walked
+// from right to left, skipping the addresses of trusted proxies, and the
+// first untrusted one is returned: entries left of it may have been forged
+// by the client. Without trusted proxies, this is the address from
+// r.RemoteAddr. The zero Addr is returned when it can't be parsed.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	client, ok := parseForwardedAddr(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+
+	hops := r.Header.Values("X-Forwarded-For")
+	for i := len(hops) - 1; i >= 0; i-- {
+		entries := strings.Split(hops[i], ",")
+		for j := len(entries) - 1; j >= 0; j-- {
+			if !isTrustedProxy(client, trustedProxies) {
+				return client
+			}
+			addr, ok := parseForwardedAddr(strings.TrimSpace(entries[j]))
+			if !ok {
+				// Whoever added a malformed entry can't be trusted, the
+				// proxy that forwarded it is the last address we know
+				return client
+			}
+			client = addr
+		}
+	}
+	return client
+}
+
+// parseForwardedAddr parses an IP address, with or without a port.
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
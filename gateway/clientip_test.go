@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		trusted    []netip.Prefix
+		expected   string
+	}{
+		{"no proxies", "203.0.113.1:1234", []string{"198.51.100.1"}, nil, "203.0.113.1"},
+		{"untrusted remote", "203.0.113.1:1234", []string{"198.51.100.1"}, trusted, "203.0.113.1"},
+		{"trusted remote", "10.0.0.1:1234", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"skips trusted hops", "10.0.0.1:1234", []string{"192.0.2.1, 198.51.100.1, 10.0.0.2"}, trusted, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234", []string{"192.0.2.1", "198.51.100.1", "10.0.0.2"}, trusted, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, trusted, "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:1234", []string{"198.51.100.1, not-an-ip"}, trusted, "10.0.0.1"},
+		{"ipv6 with port", "[fd00::1]:1234", []string{"[2001:db8::1]:443"}, trusted, "2001:db8::1"},
+		{"ipv4-mapped", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"no header", "10.0.0.1:1234", nil, trusted, "10.0.0.1"},
+		{"bad remote", "pipe", nil, trusted, "invalid IP"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, v := range test.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if ip := ClientIP(r, test.trusted); ip.String() != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// cidReprDigest returns the Repr-Digest header value of the bytes c is the
+// hash of, if its multihash is sha2-256.
+func cidReprDigest(c cid.Cid) (string, bool) {
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil || decoded.Code != mh.SHA2_256 {
+		return "", false
+	}
+	return formatReprDigest(decoded.Digest), true
+}
+
+// contentReprDigest hashes r to a Repr-Digest header value.
+func contentReprDigest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return formatReprDigest(h.Sum(nil)), nil
+}
+
+// formatReprDigest formats a SHA-256 digest as a Repr-Digest header value,
+// see RFC 9530.
+func formatReprDigest(digest []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest) + ":"
+}
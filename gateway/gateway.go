@@ -2,19 +2,586 @@ package gateway
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"sort"
+	"strings"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-libipfs/blocks"
 	"github.com/ipfs/go-libipfs/files"
+	"github.com/ipfs/go-libipfs/gateway/assets"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	"github.com/ipfs/interface-go-ipfs-core/path"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Config is the configuration used when creating a new gateway handler.
 type Config struct {
 	Headers map[string][]string
+
+	// MaxTraversalDepth bounds how deep CAR and TAR responses may descend
+	// into the requested DAG. For CAR, depth is the number of links followed
+	// from the requested root; for TAR, it is the number of nested UnixFS
+	// directories. Responses exceeding it are aborted. Zero means unlimited.
+	MaxTraversalDepth int
+
+	// ImmutableCacheControl replaces the Cache-Control value sent for
+	// immutable /ipfs/ content, e.g. to use a shorter max-age or add
+	// stale-while-revalidate for a CDN. When empty,
+	// "public, max-age=29030400, immutable" is used.
+	ImmutableCacheControl string
+
+	// CacheControlFunc, when set, returns the Cache-Control value sent for
+	// a content path, overriding ImmutableCacheControl and the default one
+	// of mutable paths, e.g. "private" or "no-store" for gated datasets.
+	// Returning an empty string keeps the default.
+	CacheControlFunc func(contentPath path.Path, isImmutable bool) string
+
+	// IsImmutableFunc, when set, decides whether responses for a content path
+	// are cached as immutable content, in place of checking that it is not
+	// Mutable, e.g. to cache an /ipns/ name that is never republished like
+	// /ipfs/ content. Its result is also passed to CacheControlFunc.
+	IsImmutableFunc func(contentPath path.Path) bool
+
+	// MethodPreservingRedirects makes the gateway's own permanent redirects,
+	// such as adding a trailing slash to directories or following ?uri=, use
+	// 308 Permanent Redirect instead of 301 Moved Permanently, which allows
+	// clients to change the method to GET. Subdomain redirects of
+	// WithHostname are not affected.
+	MethodPreservingRedirects bool
+
+	// RootRedirect is a content path, such as /ipfs/<cid>/ or /ipns/<name>/,
+	// that requests for / are redirected to with 302 Found. It lets a gateway
+	// dedicated to a single website or dataset be used without an extra
+	// reverse proxy rule. It only applies when the handler is mounted at /.
+	// When empty, requests for / fail as before.
+	RootRedirect string
+
+	// RobotsTxt is served at /robots.txt, so that crawlers don't wander the
+	// infinite space of CIDs behind a public gateway. DefaultRobotsTxt is
+	// used when nil, and nothing is served when it is empty but not nil.
+	// Mounts covering /robots.txt take precedence, and websites served
+	// through WithHostname keep their own.
+	RobotsTxt []byte
+
+	// Mounts maps URL path prefixes, such as /docs, to root CIDs, so that a
+	// site can be composed from independently published datasets without a
+	// merged DAG: /docs/intro.html is served from /ipfs/<cid>/intro.html.
+	// The longest prefix matching whole path segments applies. Prefixes must
+	// not be / or fall under the /ipfs/ and /ipns/ namespaces. Like
+	// RootRedirect, mounts only apply when the handler is mounted at /.
+	Mounts map[string]cid.Cid
+
+	// NormalizePath cleans the requested content path before it is resolved
+	// and sent in X-Ipfs-Path: . and .. segments are resolved and repeated
+	// slashes collapsed, so that equivalent spellings of a path don't
+	// fragment caches. Cleaning never climbs above the /ipfs/<cid> or
+	// /ipns/<name> root, and a trailing slash is kept.
+	NormalizePath bool
+
+	// MaxIpfsRootsHeaderBytes caps the length of the X-Ipfs-Roots header, so
+	// that deep paths don't exceed the header size limits of proxies. Past
+	// it, roots are dropped from the content root down, keeping the ones
+	// closest to the requested entity, and X-Ipfs-Roots-Truncated: true is
+	// sent. Zero means no limit.
+	MaxIpfsRootsHeaderBytes int
+
+	// MaxRedirectsRules caps the number of rules read from a _redirects file,
+	// which is untrusted content that is matched on every request it applies
+	// to. Files with more rules fail with an error. DefaultMaxRedirectsRules
+	// is used when zero.
+	MaxRedirectsRules int
+
+	// MaxRedirectsFileSize caps the size in bytes of a _redirects file. It
+	// can only lower the redirects.MaxFileSizeInBytes limit of the parser,
+	// which is used when zero.
+	MaxRedirectsFileSize int64
+
+	// FilenameValidator, if set, is given the ?filename requested by clients
+	// and returns the name to use in Content-Disposition, e.g. with path
+	// separators removed or its length capped. When it returns an error, the
+	// name derived from the content path is used instead.
+	FilenameValidator func(string) (string, error)
+
+	// DisableFormatQueryParam makes the handler ignore the ?format query
+	// parameter, so that explicit response formats such as CAR or TAR can
+	// only be requested with the Accept header. This keeps them available to
+	// API clients while preventing casual sharing of links like ?format=tar.
+	DisableFormatQueryParam bool
+
+	// TrustedProxies lists the networks of reverse proxies in front of the
+	// gateway whose X-Forwarded-For entries are believed when determining
+	// the address of the client, see ClientIP. It is logged with slow
+	// requests. When empty, the address the request came from is used.
+	TrustedProxies []netip.Prefix
+
+	// AllowedHosts lists the hosts requests may be addressed to, such as
+	// gateway.example.com, or *.example.com for any subdomain of example.com.
+	// Requests with another Host header fail with 421 Misdirected Request,
+	// which guards caches against host header poisoning when the gateway
+	// serves many DNSLink sites. When empty, every host is allowed.
+	AllowedHosts []string
+
+	// DisabledNamespaces lists the namespaces, "ipfs" or "ipns", the gateway
+	// refuses to serve with 403 Forbidden before any resolution, e.g. "ipns"
+	// for an immutable-only gateway. When empty, both are served.
+	DisabledNamespaces []string
+
+	// StripRequestHeaders lists headers removed from incoming requests before
+	// they are handled, e.g. ones injected by a CDN in front of the gateway
+	// that should not affect its behavior.
+	StripRequestHeaders []string
+
+	// ContentTypeFunc, if set, is consulted to determine the Content-Type of
+	// UnixFS files. It receives the file name and up to the first 512 bytes
+	// of the file. Returning an empty string falls back to the default
+	// extension and content based detection.
+	ContentTypeFunc func(name string, firstBytes []byte) string
+
+	// AllowMimeOverride lets the ?mime query parameter replace the
+	// Content-Type of UnixFS files, e.g. ?mime=text/markdown. Types that
+	// browsers run as active content, such as HTML, SVG, XML or JavaScript,
+	// are never honored, as anyone could otherwise make a file run scripts
+	// on the origin it is served from. Honored types are sent with
+	// X-Content-Type-Options: nosniff.
+	AllowMimeOverride bool
+
+	// TrustXForwardedHeaders makes redirects generated by the handler use
+	// the host and scheme from X-Forwarded-Host and X-Forwarded-Proto. Only
+	// enable it when the gateway runs behind a reverse proxy that sets them.
+	TrustXForwardedHeaders bool
+
+	// MaxRequestBodyBytes caps the size of request bodies. The gateway is
+	// read-only and never uses them, so larger bodies are rejected with 413
+	// instead of being read. DefaultMaxRequestBodyBytes is used when zero or
+	// negative.
+	MaxRequestBodyBytes int64
+
+	// MaxConcurrentRequests caps the number of requests handled at the same
+	// time, to protect the backend behind the API. Requests over the cap wait
+	// for up to QueueTimeout and then fail with 503 Service Unavailable. Zero
+	// means unlimited.
+	MaxConcurrentRequests int
+
+	// QueueTimeout is how long requests wait for MaxConcurrentRequests to
+	// admit them. Zero rejects requests over the cap right away.
+	QueueTimeout time.Duration
+
+	// WriteTimeout bounds how long a single write of the response body may
+	// block. A client that stops reading for longer has its response aborted
+	// instead of tying up the handler. Zero leaves write deadlines unset.
+	WriteTimeout time.Duration
+
+	// SlowRequestThreshold makes GET and HEAD requests that take longer than
+	// it to complete log a warning with their path, response format,
+	// duration and connection protocol and TLS parameters. Zero disables it.
+	SlowRequestThreshold time.Duration
+
+	// AccessLog, when set, is called after every GET and HEAD request with
+	// its status, duration and connection metadata, such as the HTTP
+	// version and TLS parameters, e.g. to compare latencies across
+	// protocols.
+	AccessLog func(AccessLogEntry)
+
+	// VerifyBlocks makes raw block and CAR responses re-hash every block with
+	// the multihash function of its CID before serving it. Raw block requests
+	// fail with 502 Bad Gateway on mismatch, CAR streams are aborted. This
+	// costs CPU on every block served.
+	VerifyBlocks bool
+
+	// ReprDigestMaxSize enables the Repr-Digest header on raw block and
+	// UnixFS file responses up to this many bytes, by hashing their content
+	// with SHA-256. The header is always sent, without hashing, for content
+	// whose CID is a sha2-256 hash of it, such as raw blocks. Zero means no
+	// content is hashed.
+	ReprDigestMaxSize int64
+
+	// MissingDNSLinkNotFound makes requests for DNSLink names that don't
+	// exist or have no DNSLink record fail with 404 Not Found instead of
+	// 500 Internal Server Error, so that typos in names don't count as
+	// server errors. Other resolution failures are still 500.
+	MissingDNSLinkNotFound bool
+
+	// GenericServerErrors makes 5xx responses carry only the status text,
+	// instead of the error that caused them, e.g. the CID of a block that
+	// could not be fetched and why. Public gateways may set it to avoid
+	// disclosing internal details. The full error is logged either way.
+	GenericServerErrors bool
+
+	// DirSort is the order of the entries in generated directory listings.
+	// The zero value lists them by name.
+	DirSort DirSort
+
+	// SitemapMaxEntries makes DNSLink sites without a /sitemap.xml of their
+	// own get one generated, listing the URLs of their HTML pages for search
+	// engines. Generating it walks the UnixFS tree of the site, visiting at
+	// most this many directory entries, and the result is cached by root CID.
+	// Zero disables it.
+	SitemapMaxEntries int
+
+	// SitemapMaxDepth bounds how many directory levels below the root of a
+	// site are walked for its sitemap. Zero means unlimited.
+	SitemapMaxDepth int
+
+	// ListingStrings translates the texts of generated directory listings,
+	// by language and then by the keys of assets.DefaultListingStrings. The
+	// language best matching the Accept-Language header of the request is
+	// used, and English when none does. Missing texts stay in English.
+	ListingStrings map[string]map[string]string
+
+	// IndexFileNames lists the files served on behalf of a directory, in
+	// order of priority, e.g. index.html then index.htm for legacy sites. The
+	// generated listing is served when none is present. ["index.html"] is
+	// used when nil, and listings are always generated when it is empty but
+	// not nil.
+	IndexFileNames []string
+
+	// IndexEarlyHints makes directories served with their index file send a
+	// 103 Early Hints response preloading the stylesheets and scripts
+	// referenced with relative URLs in its <head>, so that browsers can fetch
+	// them while the page is still loading. Clients that don't understand 1xx
+	// responses may break, which is why it is opt-in.
+	IndexEarlyHints bool
+
+	// RejectExpectContinue makes requests with 'Expect: 100-continue' fail
+	// with 417 Expectation Failed. By default 100 Continue is sent right away
+	// so that clients waiting for it before sending a body don't stall.
+	RejectExpectContinue bool
+
+	// IPNSResolveTimeout bounds the resolution of /ipns/ paths separately from
+	// fetching the content they point at. Requests whose resolution takes
+	// longer fail with 504 Gateway Timeout. Zero means no separate bound.
+	IPNSResolveTimeout time.Duration
+
+	// FirstBlockTimeout bounds fetching the root block of the resolved
+	// content, which happens before any response is sent. Requests whose
+	// root block takes longer fail with 504 Gateway Timeout. Zero means no
+	// separate bound.
+	FirstBlockTimeout time.Duration
+
+	// BlockFetchRetry retries blocks fetched with API.GetBlock that fail with
+	// transient errors, such as from a flaky remote blockstore, within the
+	// deadline of the request. Missing blocks are never retried, so that 404
+	// responses stay fast. The zero value retries nothing.
+	BlockFetchRetry RetryPolicy
+
+	// DNSLinkResolver, if set, looks up the DNSLink of the domain in
+	// /ipns/<domain> content paths instead of the API, e.g. with a chosen
+	// DNS-over-HTTPS provider rather than the system resolver. It returns the
+	// content path the DNSLink points at. Missing records should be reported
+	// with an error wrapping namesys.ErrResolveFailed or a *net.DNSError, so
+	// that MissingDNSLinkNotFound applies, and IPNSResolveTimeout bounds it.
+	DNSLinkResolver func(ctx context.Context, name string) (path.Path, error)
+
+	// ResolverCache, if set, is consulted before resolving content paths
+	// through the API, including once per path segment when building the
+	// X-Ipfs-Roots header. See NewLRUResolverCache for a default. When it is
+	// an AgingResolverCache, responses for mutable paths carry an Age header
+	// telling how long ago their resolution was cached.
+	ResolverCache ResolverCache
+
+	// RetryIPNSOnce makes /ipns/ names that fail to resolve be resolved a
+	// second time after this delay before the request fails, to smooth over
+	// the propagation of freshly published names. Only failures to resolve
+	// the name itself are retried, not missing content under it. Zero
+	// disables it.
+	RetryIPNSOnce time.Duration
+
+	// StaleWhileRevalidate lets resolutions of mutable paths, such as /ipns/
+	// names, that expired from the ResolverCache less than this long ago be
+	// used right away, while the path is resolved again in the background
+	// for later requests. Responses for mutable paths then carry
+	// Cache-Control: stale-while-revalidate. It requires a ResolverCache that
+	// is a StaleResolverCache, such as the one of NewLRUResolverCache. Zero
+	// disables it, so that every expired resolution is waited for.
+	StaleWhileRevalidate time.Duration
+
+	// CARStore, if set, is checked before generating CAR responses, and
+	// generated CARs are offered to it on a miss. Stored CARs are sent as
+	// they are: VerifyBlocks and MaxTraversalDepth only apply when they are
+	// generated.
+	CARStore CARStore
+
+	// SpanAttributesFunc, if set, returns attributes added to the tracing
+	// span of each GET and HEAD request, e.g. to slice traces by tenant or
+	// route. It is called once per request, after the content path was
+	// resolved and the response format chosen.
+	SpanAttributesFunc func(*http.Request) []attribute.KeyValue
+
+	// MetricLabels lists extra labels added to the gateway metrics, next to
+	// the namespace label. Their values are taken from MetricLabelsFunc, and
+	// default to empty. The label set of a metric is fixed when it is first
+	// registered, so all handlers in a process should use the same labels.
+	// The names "gateway" and "result" are used by the gateway itself.
+	MetricLabels []string
+
+	// MetricLabelsFunc returns the values of MetricLabels for a request, e.g.
+	// a tenant derived from the Host header.
+	MetricLabelsFunc func(*http.Request) prometheus.Labels
+
+	// Clock, if set, is used for reads of the current time such as the
+	// Last-Modified value of mutable content and request latency metrics.
+	// Deadlines set on connections, like WriteTimeout, always follow the
+	// system clock. It lets tests control time, and should otherwise keep up
+	// with the system clock, which is used when nil. Pass it to
+	// NewLRUResolverCache too so that cache expiry follows it.
+	Clock Clock
+
+	// Debug enables behavior useful when developing or troubleshooting the
+	// gateway, such as printing stack traces of recovered panics to stderr,
+	// and answering requests with ?debug=serve-plan with a JSON description
+	// of how they would be served: the resolved CID, the response format,
+	// the part of the handler serving it and the headers computed so far.
+	Debug bool
+}
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// DirSort is an order of the entries of a directory listing.
+type DirSort int
+
+const (
+	// DirSortName lists entries by name, in ascending byte order.
+	DirSortName DirSort = iota
+	// DirSortDirsFirst lists directories before other entries, each by name.
+	DirSortDirsFirst
+	// DirSortSizeDesc lists the largest entries first, and same sized ones
+	// by name.
+	DirSortSizeDesc
+	// DirSortNone keeps the order of the links in the directory DAG.
+	DirSortNone
+)
+
+// DefaultMaxRedirectsRules is the number of _redirects rules allowed when
+// Config.MaxRedirectsRules is not set, as recommended by the specification.
+const DefaultMaxRedirectsRules = 1000
+
+// DefaultMaxRequestBodyBytes is the request body size cap used when
+// Config.MaxRequestBodyBytes is not set.
+const DefaultMaxRequestBodyBytes = 4 << 10
+
+// DefaultRobotsTxt is served at /robots.txt when Config.RobotsTxt is not set.
+// It asks crawlers to stay away from content paths.
+const DefaultRobotsTxt = `User-agent: *
+Disallow: /ipfs/
+Disallow: /ipns/
+`
+
+// Validate checks the Config for values that would make the handler
+// misbehave, returning an error describing the first problem found.
+func (c Config) Validate() error {
+	for k := range c.Headers {
+		if k != http.CanonicalHeaderKey(k) {
+			return fmt.Errorf("header %q is not in canonical form, use %q", k, http.CanonicalHeaderKey(k))
+		}
+	}
+	if c.ImmutableCacheControl != "" && !validCacheControl(c.ImmutableCacheControl) {
+		return fmt.Errorf("ImmutableCacheControl %q is not a valid Cache-Control value", c.ImmutableCacheControl)
+	}
+	if c.RootRedirect != "" {
+		if err := path.New(c.RootRedirect).IsValid(); err != nil {
+			return fmt.Errorf("RootRedirect must be a valid content path: %w", err)
+		}
+	}
+	for prefix, root := range c.Mounts {
+		if err := validMountPrefix(prefix); err != nil {
+			return err
+		}
+		if !root.Defined() {
+			return fmt.Errorf("mount %q has an undefined CID", prefix)
+		}
+	}
+	for _, prefix := range c.TrustedProxies {
+		if !prefix.IsValid() {
+			return fmt.Errorf("TrustedProxies contains an invalid prefix %s", prefix)
+		}
+	}
+	for _, host := range c.AllowedHosts {
+		if err := validAllowedHost(host); err != nil {
+			return err
+		}
+	}
+	for _, ns := range c.DisabledNamespaces {
+		if ns != "ipfs" && ns != "ipns" {
+			return fmt.Errorf("DisabledNamespaces contains unknown namespace %q", ns)
+		}
+	}
+	for _, name := range c.IndexFileNames {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("IndexFileNames contains an invalid file name %q", name)
+		}
+	}
+	if c.DirSort < DirSortName || c.DirSort > DirSortNone {
+		return fmt.Errorf("unknown DirSort %d", c.DirSort)
+	}
+	if c.SitemapMaxEntries < 0 {
+		return fmt.Errorf("SitemapMaxEntries must not be negative, got %d", c.SitemapMaxEntries)
+	}
+	if c.SitemapMaxDepth < 0 {
+		return fmt.Errorf("SitemapMaxDepth must not be negative, got %d", c.SitemapMaxDepth)
+	}
+	for lang, texts := range c.ListingStrings {
+		if lang == "" || lang == "*" || strings.ContainsAny(lang, ",; ") {
+			return fmt.Errorf("ListingStrings contains an invalid language %q", lang)
+		}
+		for key := range texts {
+			if _, ok := assets.DefaultListingStrings[key]; !ok {
+				return fmt.Errorf("ListingStrings contains unknown text %q for language %q", key, lang)
+			}
+		}
+	}
+	if c.MaxTraversalDepth < 0 {
+		return fmt.Errorf("MaxTraversalDepth must not be negative, got %d", c.MaxTraversalDepth)
+	}
+	if c.MaxIpfsRootsHeaderBytes < 0 {
+		return fmt.Errorf("MaxIpfsRootsHeaderBytes must not be negative, got %d", c.MaxIpfsRootsHeaderBytes)
+	}
+	if c.MaxRedirectsRules < 0 {
+		return fmt.Errorf("MaxRedirectsRules must not be negative, got %d", c.MaxRedirectsRules)
+	}
+	if c.ReprDigestMaxSize < 0 {
+		return fmt.Errorf("ReprDigestMaxSize must not be negative, got %d", c.ReprDigestMaxSize)
+	}
+	if c.MaxRedirectsFileSize < 0 {
+		return fmt.Errorf("MaxRedirectsFileSize must not be negative, got %d", c.MaxRedirectsFileSize)
+	}
+	if c.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("MaxRequestBodyBytes must not be negative, got %d", c.MaxRequestBodyBytes)
+	}
+	for _, name := range c.MetricLabels {
+		if name == "gateway" || name == "result" {
+			return fmt.Errorf("metric label %q is reserved", name)
+		}
+	}
+	if c.MetricLabelsFunc != nil && len(c.MetricLabels) == 0 {
+		return fmt.Errorf("MetricLabelsFunc is set but MetricLabels is empty")
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return fmt.Errorf("MaxConcurrentRequests must not be negative, got %d", c.MaxConcurrentRequests)
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("QueueTimeout must not be negative, got %s", c.QueueTimeout)
+	}
+	if c.IPNSResolveTimeout < 0 {
+		return fmt.Errorf("IPNSResolveTimeout must not be negative, got %s", c.IPNSResolveTimeout)
+	}
+	if c.RetryIPNSOnce < 0 {
+		return fmt.Errorf("RetryIPNSOnce must not be negative, got %s", c.RetryIPNSOnce)
+	}
+	if c.StaleWhileRevalidate < 0 {
+		return fmt.Errorf("StaleWhileRevalidate must not be negative, got %s", c.StaleWhileRevalidate)
+	}
+	if c.StaleWhileRevalidate > 0 {
+		if _, ok := c.ResolverCache.(StaleResolverCache); !ok {
+			return fmt.Errorf("StaleWhileRevalidate requires a ResolverCache implementing StaleResolverCache")
+		}
+	}
+	if c.FirstBlockTimeout < 0 {
+		return fmt.Errorf("FirstBlockTimeout must not be negative, got %s", c.FirstBlockTimeout)
+	}
+	if c.BlockFetchRetry.MaxAttempts < 0 || c.BlockFetchRetry.Backoff < 0 || c.BlockFetchRetry.MaxBackoff < 0 {
+		return fmt.Errorf("BlockFetchRetry must not have negative values, got %+v", c.BlockFetchRetry)
+	}
+	if c.SlowRequestThreshold < 0 {
+		return fmt.Errorf("SlowRequestThreshold must not be negative, got %s", c.SlowRequestThreshold)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("WriteTimeout must not be negative, got %s", c.WriteTimeout)
+	}
+	return nil
+}
+
+// validMountPrefix checks that prefix is a URL path that a Config.Mounts
+// entry can be matched against.
+func validMountPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("mount %q must start and must not end with /", prefix)
+	}
+	switch strings.SplitN(prefix, "/", 3)[1] {
+	case "ipfs", "ipns":
+		return fmt.Errorf("mount %q shadows a content path namespace", prefix)
+	}
+	return nil
+}
+
+// validAllowedHost checks that host is a Config.AllowedHosts pattern: a host
+// name, optionally starting with a *. wildcard label.
+func validAllowedHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return fmt.Errorf("AllowedHosts contains an invalid host %q", host)
+	}
+	return nil
+}
+
+// hostAllowed returns true if host, from the Host header of a request, is
+// matched by one of the Config.AllowedHosts patterns. Ports and case are
+// ignored.
+func hostAllowed(host string, allowed []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if suffix := pattern[1:]; strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// validCacheControl checks that v is a comma separated list of Cache-Control
+// directives, each a token optionally followed by =token or ="quoted string".
+func validCacheControl(v string) bool {
+	for _, directive := range strings.Split(v, ",") {
+		name, value, hasValue := strings.Cut(strings.TrimSpace(directive), "=")
+		if !isToken(name) {
+			return false
+		}
+		if !hasValue {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if strings.ContainsAny(value[1:len(value)-1], "\"\r\n") {
+				return false
+			}
+		} else if !isToken(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// isToken reports whether s is an RFC 9110 token.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c > 127 || c <= ' ' || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
 }
 
 // API defines the minimal set of API services required for a gateway handler.
@@ -47,6 +614,27 @@ type API interface {
 	ResolvePath(context.Context, path.Path) (path.Resolved, error)
 }
 
+// CacheTier names the cache tier a block was served from.
+type CacheTier string
+
+const (
+	CacheTierMemory CacheTier = "hit-memory"
+	CacheTierDisk   CacheTier = "hit-disk"
+	CacheTierMiss   CacheTier = "miss"
+)
+
+// CacheTierAPI is an API that can report which cache tier served a block.
+// When the API passed to NewHandler implements it, the root block of the
+// requested content is fetched with GetBlockCacheTier, and responses report
+// its tier in the X-Ipfs-Cache header.
+type CacheTierAPI interface {
+	API
+
+	// GetBlockCacheTier is GetBlock also returning the cache tier the block
+	// came from, or "" when it is not known.
+	GetBlockCacheTier(context.Context, cid.Cid) (blocks.Block, CacheTier, error)
+}
+
 // A helper function to clean up a set of headers:
 // 1. Canonicalizes.
 // 2. Deduplicates.
@@ -108,6 +696,13 @@ func AddAccessControlHeaders(headers map[string][]string) {
 			"X-Stream-Output",
 			"X-Ipfs-Path",
 			"X-Ipfs-Roots",
+			"X-Ipfs-Roots-Truncated",
+			"X-Ipfs-Cache",
+			"X-Ipfs-Resolved-Ancestor",
+			"X-Ipfs-DataType",
+			"X-Ipfs-FileSize",
+			"X-Ipfs-Accept-Formats",
+			"Repr-Digest",
 		}, headers[ACEHeadersName]...))
 }
 
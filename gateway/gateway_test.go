@@ -1,26 +1,48 @@
 package gateway
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/netip"
+	"net/textproto"
+	"net/url"
 	"os"
 	gopath "path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	bsfetcher "github.com/ipfs/go-fetcher/impl/blockservice"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	format "github.com/ipfs/go-ipld-format"
+	ipns_pb "github.com/ipfs/go-ipns/pb"
 	"github.com/ipfs/go-libipfs/blocks"
 	"github.com/ipfs/go-libipfs/files"
+	"github.com/ipfs/go-libipfs/gateway/assets"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-merkledag"
 	"github.com/ipfs/go-namesys"
 	"github.com/ipfs/go-namesys/resolve"
@@ -30,16 +52,24 @@ import (
 	ufile "github.com/ipfs/go-unixfs/file"
 	uio "github.com/ipfs/go-unixfs/io"
 	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	nsopts "github.com/ipfs/interface-go-ipfs-core/options/namesys"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	gocar "github.com/ipld/go-car"
 	carblockstore "github.com/ipld/go-car/v2/blockstore"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/schema"
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/routing"
+	mc "github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+	prometheus "github.com/prometheus/client_golang/prometheus"
 )
 
 type mockNamesys map[string]path.Path
@@ -100,17 +130,17 @@ func newMockAPI(t *testing.T) (*mockAPI, cid.Cid) {
 		t.Fatal(err)
 	}
 
-	blockStore, err := carblockstore.NewReadOnly(r, nil)
+	carStore, err := carblockstore.NewReadOnly(r, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	t.Cleanup(func() {
-		blockStore.Close()
+		carStore.Close()
 		r.Close()
 	})
 
-	cids, err := blockStore.Roots()
+	cids, err := carStore.Roots()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,6 +149,23 @@ func newMockAPI(t *testing.T) (*mockAPI, cid.Cid) {
 		t.Fatal(fmt.Errorf("car has %d roots, expected 1", len(cids)))
 	}
 
+	// Copy the fixtures into a writable blockstore, so that tests can add
+	// their own content with addTestDirectory.
+	blockStore := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	keys, err := carStore.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range keys {
+		blk, err := carStore.Get(context.Background(), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blockStore.Put(context.Background(), blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
 	blockService := blockservice.New(blockStore, offline.Exchange(blockStore))
 	dagService := merkledag.NewDAGService(blockService)
 
@@ -141,6 +188,48 @@ func newMockAPI(t *testing.T) (*mockAPI, cid.Cid) {
 	}, cids[0]
 }
 
+// addTestDirectory adds a UnixFS directory with the given files to the
+// blockstore and returns its CID. Keys are slash-separated paths relative to
+// the directory, values are the file contents.
+func (api *mockAPI) addTestDirectory(t *testing.T, entries map[string]string) cid.Cid {
+	ctx := context.Background()
+
+	var build func(prefix string) *merkledag.ProtoNode
+	build = func(prefix string) *merkledag.ProtoNode {
+		dir := unixfs.EmptyDirNode()
+		subdirs := map[string]struct{}{}
+		for name, content := range entries {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			name = strings.TrimPrefix(name, prefix)
+			if sub, _, ok := strings.Cut(name, "/"); ok {
+				subdirs[sub] = struct{}{}
+				continue
+			}
+			file := merkledag.NewRawNode([]byte(content))
+			if err := api.dagService.Add(ctx, file); err != nil {
+				t.Fatal(err)
+			}
+			if err := dir.AddNodeLink(name, file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for sub := range subdirs {
+			subdir := build(prefix + sub + "/")
+			if err := dir.AddNodeLink(sub, subdir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := api.dagService.Add(ctx, dir); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	return build("").Cid()
+}
+
 func (api *mockAPI) GetUnixFsNode(ctx context.Context, p ipath.Resolved) (files.Node, error) {
 	nd, err := api.resolveNode(ctx, p)
 	if err != nil {
@@ -271,6 +360,20 @@ func (api *mockAPI) processLink(ctx context.Context, result unixfs.LinkResult) i
 		link.Size = result.Link.Size
 	case cid.DagProtobuf:
 		link.Size = result.Link.Size
+		// Like with ResolveChildren, which is the default, tell directories
+		// and files apart
+		if nd, err := api.dagService.Get(ctx, link.Cid); err == nil {
+			if pn, ok := nd.(*merkledag.ProtoNode); ok {
+				if fsn, err := unixfs.FSNodeFromBytes(pn.Data()); err == nil {
+					switch fsn.Type() {
+					case unixfs.TDirectory, unixfs.THAMTShard:
+						link.Type = iface.TDirectory
+					case unixfs.TFile:
+						link.Type = iface.TFile
+					}
+				}
+			}
+		}
 	}
 
 	return link
@@ -297,7 +400,11 @@ func newTestServerAndNode(t *testing.T, ns mockNamesys) (*httptest.Server, *mock
 }
 
 func newTestServer(t *testing.T, api API) *httptest.Server {
-	config := Config{Headers: map[string][]string{}}
+	return newTestServerWithConfig(t, api, Config{})
+}
+
+func newTestServerWithConfig(t *testing.T, api API, config Config) *httptest.Server {
+	config.Headers = map[string][]string{}
 	AddAccessControlHeaders(config.Headers)
 
 	handler := NewHandler(config, api)
@@ -363,7 +470,7 @@ func TestGatewayGet(t *testing.T) {
 		{"working.example.com", "/", http.StatusOK, "fnord"},
 		{"double.example.com", "/", http.StatusOK, "fnord"},
 		{"triple.example.com", "/", http.StatusOK, "fnord"},
-		{"working.example.com", k.String(), http.StatusNotFound, "failed to resolve /ipns/working.example.com" + k.String() + ": no link named \"ipfs\" under " + k.Cid().String() + "\n"},
+		{"working.example.com", k.String(), http.StatusNotFound, "failed to resolve /ipns/working.example.com" + k.String() + ": no link named \"ipfs\" under " + k.Cid().String() + " (deepest resolved ancestor: /ipns/working.example.com, " + k.Cid().String() + ")\n"},
 		{"broken.example.com", "/", http.StatusInternalServerError, "failed to resolve /ipns/broken.example.com/: " + namesys.ErrResolveFailed.Error() + "\n"},
 		{"broken.example.com", k.String(), http.StatusInternalServerError, "failed to resolve /ipns/broken.example.com" + k.String() + ": " + namesys.ErrResolveFailed.Error() + "\n"},
 		// This test case ensures we don't treat the TLD as a file extension.
@@ -692,7 +799,7 @@ func TestPretty404(t *testing.T) {
 		{"/nope", "text/html", http.StatusNotFound, "Custom 404"},
 		{"/nope", "text/*", http.StatusNotFound, "Custom 404"},
 		{"/nope", "*/*", http.StatusNotFound, "Custom 404"},
-		{"/nope", "application/json", http.StatusNotFound, fmt.Sprintf("failed to resolve /ipns/example.net/nope: no link named \"nope\" under %s\n", k.Cid().String())},
+		{"/nope", "application/json", http.StatusNotFound, fmt.Sprintf("failed to resolve /ipns/example.net/nope: no link named \"nope\" under %s (deepest resolved ancestor: /ipns/example.net, %s)\n", k.Cid().String(), k.Cid().String())},
 		{"/deeper/nope", "text/html", http.StatusNotFound, "Deep custom 404"},
 		{"/deeper/", "text/html", http.StatusOK, ""},
 		{"/deeper", "text/html", http.StatusOK, ""},
@@ -726,6 +833,116 @@ func TestPretty404(t *testing.T) {
 	}
 }
 
+func TestResolvedAncestorHint(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+
+	dirPath := ipath.New("/ipfs/" + root.String() + "/TestGatewayGet")
+	dir, err := api.ResolvePath(context.Background(), dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		ancestor string
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/missing/file", dirPath.String()},
+		// the missing link shares its name with an ancestor that did resolve
+		{"/ipfs/" + root.String() + "/TestGatewayGet/TestGatewayGet", dirPath.String()},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", test.path, res.StatusCode)
+		}
+		if got := res.Header.Get("X-Ipfs-Resolved-Ancestor"); got != test.ancestor {
+			t.Errorf("%s: expected X-Ipfs-Resolved-Ancestor %q, got %q", test.path, test.ancestor, got)
+		}
+		if !strings.Contains(string(body), dir.Cid().String()) {
+			t.Errorf("%s: expected ancestor CID in %q", test.path, body)
+		}
+	}
+}
+
+func TestDisabledNamespaces(t *testing.T) {
+	api, root := newMockAPI(t)
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+	ts := newTestServerWithConfig(t, api, Config{DisabledNamespaces: []string{"ipns"}})
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", http.StatusOK},
+		{"/ipns/example.net/TestGatewayGet/fnord", http.StatusForbidden},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, res.StatusCode)
+		}
+	}
+}
+
+// lateNameMockAPI fails to resolve /ipns/ names the first time.
+type lateNameMockAPI struct {
+	*mockAPI
+	resolves int32
+}
+
+func (api *lateNameMockAPI) ResolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	if atomic.AddInt32(&api.resolves, 1) == 1 && p.Namespace() == "ipns" {
+		return nil, fmt.Errorf("resolving %s: %w", p, namesys.ErrResolveFailed)
+	}
+	return api.mockAPI.ResolvePath(ctx, p)
+}
+
+func TestRetryIPNSOnce(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		late   bool
+		delay  time.Duration
+		path   string
+		status int
+	}{
+		{"disabled", true, 0, "/ipns/example.net/TestGatewayGet/fnord", http.StatusInternalServerError},
+		{"retried", true, time.Millisecond, "/ipns/example.net/TestGatewayGet/fnord", http.StatusOK},
+		// missing content under a resolved name is not waited for
+		{"missing content", false, time.Hour, "/ipns/example.net/TestGatewayGet/missing", http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mock, root := newMockAPI(t)
+			mock.namesys["/ipns/example.net"] = path.FromCid(root)
+			var api API = mock
+			if test.late {
+				api = &lateNameMockAPI{mockAPI: mock}
+			}
+			ts := newTestServerWithConfig(t, api, Config{RetryIPNSOnce: test.delay})
+
+			client := &http.Client{Timeout: 5 * time.Second}
+			res, err := client.Get(ts.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Errorf("expected %d, got %d", test.status, res.StatusCode)
+			}
+		})
+	}
+}
+
 func TestCacheControlImmutable(t *testing.T) {
 	ts, _, root := newTestServerAndNode(t, nil)
 	t.Logf("test server url: %s", ts.URL)
@@ -751,6 +968,74 @@ func TestCacheControlImmutable(t *testing.T) {
 	}
 }
 
+func TestCacheControlFunc(t *testing.T) {
+	api, root := newMockAPI(t)
+	private := api.addTestDirectory(t, map[string]string{"secret": "shh"})
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+	ts := newTestServerWithConfig(t, api, Config{
+		CacheControlFunc: func(contentPath ipath.Path, isImmutable bool) string {
+			if strings.HasPrefix(contentPath.String(), "/ipfs/"+private.String()+"/") {
+				return "private, no-store"
+			}
+			if !isImmutable {
+				return "public, max-age=60"
+			}
+			return ""
+		},
+	})
+
+	for _, test := range []struct {
+		path         string
+		cacheControl string
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", immutableCacheControl},
+		{"/ipns/example.net/TestGatewayGet/fnord", "public, max-age=60"},
+		{"/ipfs/" + private.String() + "/secret", "private, no-store"},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Cache-Control"); got != test.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.path, test.cacheControl, got)
+		}
+	}
+}
+
+func TestIsImmutableFunc(t *testing.T) {
+	api, root := newMockAPI(t)
+	api.namesys["/ipns/stable.example.net"] = path.FromCid(root)
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+	ts := newTestServerWithConfig(t, api, Config{
+		IsImmutableFunc: func(contentPath ipath.Path) bool {
+			return !contentPath.Mutable() || strings.HasPrefix(contentPath.String(), "/ipns/stable.example.net/")
+		},
+	})
+
+	for _, test := range []struct {
+		path         string
+		cacheControl string
+		lastModified bool
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", immutableCacheControl, false},
+		{"/ipns/stable.example.net/TestGatewayGet/fnord", immutableCacheControl, false},
+		{"/ipns/example.net/TestGatewayGet/fnord", "", true},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Cache-Control"); got != test.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.path, test.cacheControl, got)
+		}
+		if got := res.Header.Get("Last-Modified") != ""; got != test.lastModified {
+			t.Errorf("%s: expected Last-Modified to be set: %t", test.path, test.lastModified)
+		}
+	}
+}
+
 func TestGoGetSupport(t *testing.T) {
 	ts, _, root := newTestServerAndNode(t, nil)
 	t.Logf("test server url: %s", ts.URL)
@@ -770,3 +1055,2522 @@ func TestGoGetSupport(t *testing.T) {
 		t.Errorf("status is %d, expected 200", res.StatusCode)
 	}
 }
+
+func TestMaxTraversalDepthTAR(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{MaxTraversalDepth: 2})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path      string
+		truncated bool
+	}{
+		{"/ipfs/" + root.String() + "/TestIPNSHostnameBacklinks/foo%3F%20%23%3C%27", false},
+		{"/ipfs/" + root.String() + "/TestIPNSHostnameBacklinks", true},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path+"?format=tar", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if truncated := strings.Contains(string(body), ErrMaxTraversalDepth.Error()); truncated != test.truncated {
+			t.Errorf("%s: expected truncated=%t, got %t", test.path, test.truncated, truncated)
+		}
+	}
+}
+
+func TestMaxTraversalDepthCAR(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{MaxTraversalDepth: 1})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path      string
+		truncated bool
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet", false},
+		{"/ipfs/" + root.String(), true},
+	} {
+		// A truncated CAR must not look like a complete one: the connection
+		// is dropped, either before or while reading the body
+		res, err := http.Get(ts.URL + test.path + "?format=car")
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		if truncated := err != nil; truncated != test.truncated {
+			t.Errorf("%s: expected truncated=%t, got error %v", test.path, test.truncated, err)
+		}
+	}
+}
+
+func TestCARStreamErrorTrailer(t *testing.T) {
+	api, _ := newMockAPI(t)
+	complete := api.addTestDirectory(t, map[string]string{"a": "complete"})
+	truncated := api.addTestDirectory(t, map[string]string{"a": "missing"})
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	// Remove the file block, so that the CAR fails after the 200 OK was sent
+	nd, err := api.dagService.Get(context.Background(), truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.blockStore.DeleteBlock(context.Background(), nd.Links()[0].Cid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		root      cid.Cid
+		truncated bool
+	}{
+		{complete, false},
+		{truncated, true},
+	} {
+		res, err := http.Get(ts.URL + "/ipfs/" + test.root.String() + "?format=car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
+		}
+		if _, announced := res.Trailer["X-Stream-Error"]; !announced {
+			t.Errorf("expected the X-Stream-Error trailer to be announced, got %v", res.Trailer)
+		}
+		if streamErr := res.Trailer.Get("X-Stream-Error"); (streamErr != "") != test.truncated {
+			t.Errorf("%s: expected truncated=%t, got X-Stream-Error %q", test.root, test.truncated, streamErr)
+		}
+	}
+}
+
+// memCARStore is a CARStore keeping CARs in memory.
+type memCARStore struct {
+	mu   sync.Mutex
+	cars map[string][]byte
+	gets int
+}
+
+func (s *memCARStore) Get(_ context.Context, key string) (io.ReadCloser, int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	car, ok := s.cars[key]
+	if !ok {
+		return nil, 0, false, nil
+	}
+	return io.NopCloser(bytes.NewReader(car)), int64(len(car)), true, nil
+}
+
+func (s *memCARStore) Put(_ context.Context, key string, r io.Reader) error {
+	car, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cars[key] = car
+	return nil
+}
+
+func TestCARStore(t *testing.T) {
+	api, _ := newMockAPI(t)
+	root := api.addTestDirectory(t, map[string]string{"a": "stored"})
+	nd, err := api.dagService.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileCid := nd.Links()[0].Cid
+	store := &memCARStore{cars: make(map[string][]byte)}
+	ts := newTestServerWithConfig(t, api, Config{CARStore: store})
+	t.Logf("test server url: %s", ts.URL)
+
+	get := func(urlPath string) (*http.Response, []byte) {
+		t.Helper()
+		res, err := http.Get(ts.URL + urlPath + "?format=car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", urlPath, res.StatusCode)
+		}
+		return res, body
+	}
+
+	// A miss is generated and stored under the path roots
+	urlPath := "/ipfs/" + root.String() + "/a"
+	generated, car := get(urlPath)
+	key := root.String() + "/" + fileCid.String()
+	if stored := store.cars[key]; !bytes.Equal(stored, car) {
+		t.Fatalf("expected the generated CAR to be stored under %s, got %d bytes, sent %d", key, len(stored), len(car))
+	}
+
+	// A hit is sent as stored, with the same Etag and a Content-Length
+	store.cars[key] = []byte("precomputed")
+	res, body := get(urlPath)
+	if string(body) != "precomputed" {
+		t.Errorf("expected the stored CAR, got %q", body)
+	}
+	if res.ContentLength != int64(len("precomputed")) {
+		t.Errorf("expected Content-Length %d, got %d", len("precomputed"), res.ContentLength)
+	}
+	if res.Header.Get("Etag") != generated.Header.Get("Etag") {
+		t.Errorf("expected Etag %q, got %q", generated.Header.Get("Etag"), res.Header.Get("Etag"))
+	}
+	if store.gets != 2 {
+		t.Errorf("expected 2 store lookups, got %d", store.gets)
+	}
+}
+
+func TestForcedContentType(t *testing.T) {
+	api, root := newMockAPI(t)
+	file := "/ipfs/" + root.String() + "/TestIPNSHostnameBacklinks/file.txt"
+
+	for _, test := range []struct {
+		allow   bool
+		query   string
+		ctype   string
+		nosniff bool
+	}{
+		{true, "", "text/plain; charset=utf-8", false},
+		{false, "?mime=text/markdown", "text/plain; charset=utf-8", false},
+		{true, "?mime=text/markdown", "text/markdown", true},
+		{true, "?mime=" + url.QueryEscape("Text/Markdown; Charset=utf-8"), "text/markdown; charset=utf-8", true},
+		{true, "?mime=text", "text/plain; charset=utf-8", false},
+		{true, "?mime=" + url.QueryEscape("text/html\r\nX-Injected: 1"), "text/plain; charset=utf-8", false},
+		// active content would run scripts on the origin of the gateway
+		{true, "?mime=text/html", "text/plain; charset=utf-8", false},
+		{true, "?mime=" + url.QueryEscape("Text/HTML; charset=utf-8"), "text/plain; charset=utf-8", false},
+		{true, "?mime=image/svg%2Bxml", "text/plain; charset=utf-8", false},
+		{true, "?mime=application/xhtml%2Bxml", "text/plain; charset=utf-8", false},
+		{true, "?mime=text/javascript", "text/plain; charset=utf-8", false},
+		{true, "?mime=text/xml", "text/plain; charset=utf-8", false},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{AllowMimeOverride: test.allow})
+		res, err := http.Get(ts.URL + file + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if ctype := res.Header.Get("Content-Type"); ctype != test.ctype {
+			t.Errorf("%q: expected Content-Type %q, got %q", test.query, test.ctype, ctype)
+		}
+		if nosniff := res.Header.Get("X-Content-Type-Options") == "nosniff"; nosniff != test.nosniff {
+			t.Errorf("%q: expected nosniff %t", test.query, test.nosniff)
+		}
+	}
+}
+
+func TestContentTypeFunc(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{
+		ContentTypeFunc: func(name string, firstBytes []byte) string {
+			if string(firstBytes) == "fnord" {
+				return "application/x-fnord"
+			}
+			return ""
+		},
+	})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path  string
+		ctype string
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", "application/x-fnord"},
+		{"/ipfs/" + root.String() + "/TestIPNSHostnameBacklinks/file.txt", "text/plain; charset=utf-8"},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if ctype := res.Header.Get("Content-Type"); ctype != test.ctype {
+			t.Errorf("%s: expected Content-Type %q, got %q", test.path, test.ctype, ctype)
+		}
+	}
+}
+
+func TestRedirectsSPAFallback(t *testing.T) {
+	ts, api, _ := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	spa := api.addTestDirectory(t, map[string]string{
+		"_redirects":    "/* /index.html 200\n",
+		"index.html":    "spa index",
+		"assets/app.js": "app",
+	})
+	api.namesys["/ipns/spa.example.com"] = path.FromCid(spa)
+
+	for _, test := range []struct {
+		path   string
+		status int
+		text   string
+	}{
+		{"/", http.StatusOK, "spa index"},
+		{"/some/client/route", http.StatusOK, "spa index"},
+		{"/some/client/route/", http.StatusOK, "spa index"},
+		{"/assets/app.js", http.StatusOK, "app"},
+		{"/assets/missing.js", http.StatusOK, "spa index"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "spa.example.com"
+
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", test.path, test.status, res.StatusCode, body)
+			continue
+		}
+		if string(body) != test.text {
+			t.Errorf("%s: expected body %q, got %q", test.path, test.text, body)
+		}
+		if loc := res.Header.Get("Location"); loc != "" {
+			t.Errorf("%s: expected no redirect, got Location %q", test.path, loc)
+		}
+	}
+}
+
+func TestRedirectsPlaceholders(t *testing.T) {
+	ts, api, _ := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	site := api.addTestDirectory(t, map[string]string{
+		"_redirects": strings.Join([]string{
+			"/posts/:slug /articles/:slug 301",
+			"/old/* /new/:splat 302",
+			"/q/:id /search?id=:id#top 301",
+			"/docs/:slug /content/:slug.html 200",
+			"/app/* /index.html?from=:splat 200",
+		}, "\n") + "\n",
+		"index.html":         "index",
+		"content/hello.html": "hello",
+	})
+	api.namesys["/ipns/site.example.com"] = path.FromCid(site)
+
+	for _, test := range []struct {
+		path     string
+		status   int
+		location string
+		text     string
+	}{
+		{"/posts/hello-world", http.StatusMovedPermanently, "/articles/hello-world", ""},
+		{"/old/a/b/c", http.StatusFound, "/new/a/b/c", ""},
+		{"/q/42", http.StatusMovedPermanently, "/search?id=42#top", ""},
+		{"/docs/hello", http.StatusOK, "", "hello"},
+		{"/app/some/route", http.StatusOK, "", "index"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "site.example.com"
+
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the body of redirects is closed by doWithoutRedirect
+		var body []byte
+		if test.text != "" {
+			body, err = io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", test.path, test.status, res.StatusCode, body)
+			continue
+		}
+		if loc := res.Header.Get("Location"); loc != test.location {
+			t.Errorf("%s: expected Location %q, got %q", test.path, test.location, loc)
+		}
+		if string(body) != test.text {
+			t.Errorf("%s: expected body %q, got %q", test.path, test.text, body)
+		}
+	}
+}
+
+func TestRedirectsLimits(t *testing.T) {
+	api, _ := newMockAPI(t)
+	site := api.addTestDirectory(t, map[string]string{
+		"_redirects": "/a /index.html 200\n/b /index.html 200\n/c /index.html 200\n",
+		"index.html": "index",
+	})
+	api.namesys["/ipns/site.example.com"] = path.FromCid(site)
+
+	for _, test := range []struct {
+		name   string
+		config Config
+		status int
+	}{
+		{"defaults", Config{}, http.StatusOK},
+		{"too many rules", Config{MaxRedirectsRules: 2}, http.StatusInternalServerError},
+		{"too large", Config{MaxRedirectsFileSize: 16}, http.StatusInternalServerError},
+	} {
+		ts := newTestServerWithConfig(t, api, test.config)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "site.example.com"
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, res.StatusCode)
+		}
+	}
+}
+
+func TestUriQueryRedirectXForwarded(t *testing.T) {
+	api, _ := newMockAPI(t)
+	cid := "QmbWqxBEKC3P8tqsKc98xmWNzrzDtRLMiMPL8wBuTGsMnR"
+
+	for _, test := range []struct {
+		trust    bool
+		headers  map[string]string
+		location string
+	}{
+		{false, map[string]string{"X-Forwarded-Host": "gw.example.com"}, "/ipfs/" + cid},
+		{true, map[string]string{}, "/ipfs/" + cid},
+		{true, map[string]string{"X-Forwarded-Host": "gw.example.com"}, "http://gw.example.com/ipfs/" + cid},
+		{true, map[string]string{"X-Forwarded-Host": "gw.example.com", "X-Forwarded-Proto": "https"}, "https://gw.example.com/ipfs/" + cid},
+		{true, map[string]string{"X-Forwarded-Host": "gw.example.com, proxy.internal", "X-Forwarded-Proto": "https, http"}, "https://gw.example.com/ipfs/" + cid},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{TrustXForwardedHeaders: test.trust})
+
+		r, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/?uri=ipfs://"+cid, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		resp, err := doWithoutRedirect(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("(%v) got %d, expected %d", test.headers, resp.StatusCode, http.StatusMovedPermanently)
+		}
+		if locHdr := resp.Header.Get("Location"); locHdr != test.location {
+			t.Errorf("(%v) location header got %s, expected %s", test.headers, locHdr, test.location)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+		valid  bool
+	}{
+		{"zero value", Config{}, true},
+		{"canonical headers", Config{Headers: map[string][]string{"Access-Control-Allow-Origin": {"*"}}}, true},
+		{"non-canonical headers", Config{Headers: map[string][]string{"access-control-allow-origin": {"*"}}}, false},
+		{"negative MaxTraversalDepth", Config{MaxTraversalDepth: -1}, false},
+		{"negative MaxRequestBodyBytes", Config{MaxRequestBodyBytes: -1}, false},
+		{"negative MaxRedirectsRules", Config{MaxRedirectsRules: -1}, false},
+		{"ImmutableCacheControl", Config{ImmutableCacheControl: "public, max-age=3600, stale-while-revalidate=60"}, true},
+		{"invalid ImmutableCacheControl", Config{ImmutableCacheControl: "max-age=1 day"}, false},
+		{"Mounts", Config{Mounts: map[string]cid.Cid{"/docs": cid.MustParse("bafkqaaa")}}, true},
+		{"Mounts with trailing slash", Config{Mounts: map[string]cid.Cid{"/docs/": cid.MustParse("bafkqaaa")}}, false},
+		{"Mounts under /ipfs", Config{Mounts: map[string]cid.Cid{"/ipfs/docs": cid.MustParse("bafkqaaa")}}, false},
+		{"Mounts with undefined CID", Config{Mounts: map[string]cid.Cid{"/docs": cid.Undef}}, false},
+		{"negative MaxRedirectsFileSize", Config{MaxRedirectsFileSize: -1}, false},
+		{"negative ReprDigestMaxSize", Config{ReprDigestMaxSize: -1}, false},
+		{"negative WriteTimeout", Config{WriteTimeout: -time.Second}, false},
+		{"negative IPNSResolveTimeout", Config{IPNSResolveTimeout: -time.Second}, false},
+		{"negative RetryIPNSOnce", Config{RetryIPNSOnce: -time.Second}, false},
+		{"negative StaleWhileRevalidate", Config{StaleWhileRevalidate: -time.Second}, false},
+		{"StaleWhileRevalidate without ResolverCache", Config{StaleWhileRevalidate: time.Minute}, false},
+		{"negative FirstBlockTimeout", Config{FirstBlockTimeout: -time.Second}, false},
+		{"negative BlockFetchRetry", Config{BlockFetchRetry: RetryPolicy{MaxAttempts: 3, Backoff: -time.Second}}, false},
+		{"negative SlowRequestThreshold", Config{SlowRequestThreshold: -time.Second}, false},
+		{"valid RootRedirect", Config{RootRedirect: "/ipns/example.net/"}, true},
+		{"invalid RootRedirect", Config{RootRedirect: "/foo/bar"}, false},
+		{"reserved metric label", Config{MetricLabels: []string{"gateway"}}, false},
+		{"negative MaxIpfsRootsHeaderBytes", Config{MaxIpfsRootsHeaderBytes: -1}, false},
+		{"unknown DirSort", Config{DirSort: DirSortNone + 1}, false},
+		{"negative SitemapMaxEntries", Config{SitemapMaxEntries: -1}, false},
+		{"negative SitemapMaxDepth", Config{SitemapMaxDepth: -1}, false},
+		{"ListingStrings", Config{ListingStrings: map[string]map[string]string{"fr": {"index-of": "Index de"}}}, true},
+		{"ListingStrings with unknown text", Config{ListingStrings: map[string]map[string]string{"fr": {"name": "Nom"}}}, false},
+		{"ListingStrings with invalid language", Config{ListingStrings: map[string]map[string]string{"fr, de": {"index-of": "Index de"}}}, false},
+		{"TrustedProxies", Config{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}, true},
+		{"invalid TrustedProxies", Config{TrustedProxies: []netip.Prefix{{}}}, false},
+		{"DisabledNamespaces", Config{DisabledNamespaces: []string{"ipns"}}, true},
+		{"unknown DisabledNamespaces", Config{DisabledNamespaces: []string{"/ipns/"}}, false},
+		{"AllowedHosts", Config{AllowedHosts: []string{"example.com", "*.example.net"}}, true},
+		{"AllowedHosts with inner wildcard", Config{AllowedHosts: []string{"a.*.example.com"}}, false},
+		{"AllowedHosts with port", Config{AllowedHosts: []string{"example.com:8080"}}, false},
+		{"IndexFileNames", Config{IndexFileNames: []string{"index.html", "index.htm"}}, true},
+		{"IndexFileNames with path", Config{IndexFileNames: []string{"docs/index.html"}}, false},
+		{"reserved result metric label", Config{MetricLabels: []string{"result"}}, false},
+		{"metric labels func without labels", Config{MetricLabelsFunc: func(*http.Request) prometheus.Labels { return nil }}, false},
+	} {
+		if err := test.config.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%t, got error %v", test.name, test.valid, err)
+		}
+	}
+}
+
+type unknownSizeFileAPI struct {
+	*mockAPI
+}
+
+func (api *unknownSizeFileAPI) GetUnixFsNode(ctx context.Context, p ipath.Resolved) (files.Node, error) {
+	nd, err := api.mockAPI.GetUnixFsNode(ctx, p)
+	if f, ok := nd.(files.File); ok {
+		return files.NewReaderFile(f), nil
+	}
+	return nd, err
+}
+
+func TestUnixFSFileUnknownSize(t *testing.T) {
+	mock, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, &unknownSizeFileAPI{mockAPI: mock}, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	res, err := http.Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK || string(body) != "fnord" {
+		t.Fatalf("expected 200 with the file, got %d %q", res.StatusCode, body)
+	}
+	// net/http only falls back to chunked encoding for larger bodies, range
+	// requests being disabled shows the file was streamed without a size
+	if ar := res.Header.Get("Accept-Ranges"); ar != "none" {
+		t.Errorf("expected Accept-Ranges: none, got %q", ar)
+	}
+}
+
+func TestUnixFSFileContentLength(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path string
+		size string
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", "5"},
+		{"/ipfs/" + root.String() + "/TestIPNSHostnameRedirect/_", "0"},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req, err := http.NewRequest(method, ts.URL+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := doWithoutRedirect(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if cl := res.Header.Get("Content-Length"); cl != test.size {
+				t.Errorf("%s %s: expected Content-Length %q, got %q", method, test.path, test.size, cl)
+			}
+			if len(res.TransferEncoding) != 0 {
+				t.Errorf("%s %s: expected no Transfer-Encoding, got %v", method, test.path, res.TransferEncoding)
+			}
+		}
+	}
+}
+
+func TestAcceptFallback(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"application/vnd.ipld.foo, application/vnd.ipld.raw", http.StatusOK, "application/vnd.ipld.raw"},
+		{"application/vnd.ipfs.ipns-record, application/vnd.ipld.car", http.StatusOK, "application/vnd.ipld.car"},
+		{"application/x-tar, application/vnd.ipld.raw", http.StatusOK, "application/x-tar"},
+		{"application/vnd.ipld.foo, application/vnd.ipfs.ipns-record", http.StatusNotAcceptable, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("Accept %q: expected status %d, got %d", test.accept, test.status, res.StatusCode)
+			continue
+		}
+		if test.contentType != "" && !strings.HasPrefix(res.Header.Get("Content-Type"), test.contentType) {
+			t.Errorf("Accept %q: expected Content-Type %q, got %q", test.accept, test.contentType, res.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestDataTypeHeaders(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path     string
+		dataType string
+		fileSize string
+	}{
+		{"/ipfs/" + root.String() + "/", "directory", ""},
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", "file", "5"},
+		{"/ipfs/" + root.String() + "/TestIPNSHostnameRedirect/_", "file", "0"},
+	} {
+		req, err := http.NewRequest(http.MethodHead, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if dt := res.Header.Get("X-Ipfs-DataType"); dt != test.dataType {
+			t.Errorf("%s: expected X-Ipfs-DataType %q, got %q", test.path, test.dataType, dt)
+		}
+		if fs := res.Header.Get("X-Ipfs-FileSize"); fs != test.fileSize {
+			t.Errorf("%s: expected X-Ipfs-FileSize %q, got %q", test.path, test.fileSize, fs)
+		}
+	}
+}
+
+func TestFormatsDiscovery(t *testing.T) {
+	ts, _, _ := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	res, err := http.Get(ts.URL + "/ipfs?formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+
+	var body struct {
+		Formats []struct {
+			MediaType string `json:"mediaType"`
+			Format    string `json:"format"`
+		} `json:"formats"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Formats) != len(knownResponseFormats) {
+		t.Fatalf("expected %d formats, got %d", len(knownResponseFormats), len(body.Formats))
+	}
+	if body.Formats[1].MediaType != "application/vnd.ipld.car" || body.Formats[1].Format != "car" {
+		t.Errorf("unexpected format entry %+v", body.Formats[1])
+	}
+}
+
+func TestCARSubPathRoots(t *testing.T) {
+	ts, api, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+	ctx := context.Background()
+
+	dir, err := api.ResolvePath(ctx, ipath.Join(ipath.IpfsPath(root), "TestGatewayGet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := api.ResolvePath(ctx, ipath.Join(ipath.IpfsPath(root), "TestGatewayGet", "fnord"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		root   cid.Cid
+		blocks []cid.Cid
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", file.Cid(), []cid.Cid{root, dir.Cid(), file.Cid()}},
+		{"/ipfs/" + file.Cid().String(), file.Cid(), []cid.Cid{file.Cid()}},
+	} {
+		res, err := http.Get(ts.URL + test.path + "?format=car")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cr, err := gocar.NewCarReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cr.Header.Roots) != 1 || !cr.Header.Roots[0].Equals(test.root) {
+			t.Errorf("%s: expected roots [%s], got %v", test.path, test.root, cr.Header.Roots)
+		}
+
+		var got []cid.Cid
+		for {
+			blk, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, blk.Cid())
+		}
+		res.Body.Close()
+
+		if len(got) != len(test.blocks) {
+			t.Fatalf("%s: expected blocks %v, got %v", test.path, test.blocks, got)
+		}
+		for i := range got {
+			if !got[i].Equals(test.blocks[i]) {
+				t.Errorf("%s: expected block %d to be %s, got %s", test.path, i, test.blocks[i], got[i])
+			}
+		}
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{StripRequestHeaders: []string{"accept"}})
+	t.Logf("test server url: %s", ts.URL)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String()+"/TestGatewayGet/fnord", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct == "application/vnd.ipld.raw" {
+		t.Error("expected stripped Accept header to be ignored")
+	}
+}
+
+func TestPreferReturnMinimalHeaders(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, prefer := range []string{"", "return=minimal"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String()+"/TestGatewayGet/fnord", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if vary := res.Header.Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Prefer") {
+			t.Errorf("Prefer %q: expected Vary to include Prefer, got %q", prefer, vary)
+		}
+		if hasRoots := res.Header.Get("X-Ipfs-Roots") != ""; hasRoots != (prefer == "") {
+			t.Errorf("Prefer %q: unexpected X-Ipfs-Roots %q", prefer, res.Header.Get("X-Ipfs-Roots"))
+		}
+	}
+}
+
+func TestContentLocation(t *testing.T) {
+	ts, api, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+
+	for _, test := range []struct {
+		host     string
+		path     string
+		prefer   string
+		location string
+	}{
+		{"", "/ipns/example.net/TestGatewayGet/fnord", "", "/ipfs/" + root.String() + "/TestGatewayGet/fnord"},
+		{"", "/ipns/example.net/TestGatewayGet/fnord", "return=minimal", "/ipfs/" + root.String() + "/TestGatewayGet/fnord"},
+		{"", "/ipns/example.net/TestIPNSHostnameBacklinks/foo%3F%20%23%3C%27/", "", "/ipfs/" + root.String() + "/TestIPNSHostnameBacklinks/foo%3F%20%23%3C%27/"},
+		{"", "/ipfs/" + root.String() + "/TestGatewayGet/fnord", "", ""},
+		{"example.net", "/TestGatewayGet/fnord", "", ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.prefer != "" {
+			req.Header.Set("Prefer", test.prefer)
+		}
+		if test.host != "" {
+			req.Host = test.host
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s%s: expected 200, got %d", test.host, test.path, res.StatusCode)
+		}
+		if loc := res.Header.Get("Content-Location"); loc != test.location {
+			t.Errorf("%s%s: expected Content-Location %q, got %q", test.host, test.path, test.location, loc)
+		}
+	}
+}
+
+func TestNotAcceptableListsFormats(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		accept      string
+		contentType string
+	}{
+		{"application/vnd.ipld.foo", "text/plain; charset=utf-8"},
+		{"application/vnd.ipld.foo, application/problem+json", "application/json"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("Accept %q: expected 406, got %d", test.accept, res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("Accept %q: expected Content-Type %q, got %q", test.accept, test.contentType, ct)
+		}
+		if !strings.Contains(string(body), "application/vnd.ipld.car") {
+			t.Errorf("Accept %q: expected supported formats in body, got %q", test.accept, body)
+		}
+		if test.contentType == "application/json" {
+			var reply struct {
+				Supported []string `json:"supported"`
+			}
+			if err := json.Unmarshal(body, &reply); err != nil || len(reply.Supported) != len(knownResponseFormats) {
+				t.Errorf("Accept %q: expected JSON list of formats, got %q", test.accept, body)
+			}
+		}
+	}
+}
+
+func TestRootRedirect(t *testing.T) {
+	api, root := newMockAPI(t)
+	target := "/ipfs/" + root.String() + "/"
+	ts := httptest.NewServer(NewHandler(Config{RootRedirect: target}, api))
+	t.Cleanup(func() { ts.Close() })
+	t.Logf("test server url: %s", ts.URL)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Errorf("expected 302, got %d", res.StatusCode)
+	}
+	if loc := res.Header.Get("Location"); loc != target {
+		t.Errorf("expected Location %q, got %q", target, loc)
+	}
+}
+
+func TestFilenameValidator(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{
+		FilenameValidator: func(name string) (string, error) {
+			if strings.ContainsAny(name, `/\`) {
+				return "", errors.New("path separators are not allowed")
+			}
+			return strings.ToLower(name), nil
+		},
+	})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		query       string
+		disposition string
+	}{
+		{"?filename=Fnord.TXT", `inline; filename="fnord.txt"`},
+		{"?filename=../../etc/passwd", ""},
+		{"?format=raw&filename=Fnord.BIN", `attachment; filename="fnord.bin"`},
+		{"?format=raw&filename=a/b", `attachment; filename="` + "bafkreiba3vpkcqpc6xtp3hsatzcod6iwneouzjoq7ymy4m2js6gc3czt6i.bin" + `"`},
+	} {
+		res, err := http.Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if cd := res.Header.Get("Content-Disposition"); cd != test.disposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", test.query, test.disposition, cd)
+		}
+	}
+}
+
+type ipnsRecordMockAPI struct {
+	*mockAPI
+	record []byte
+}
+
+func (api *ipnsRecordMockAPI) GetIPNSRecord(ctx context.Context, c cid.Cid) ([]byte, error) {
+	return api.record, nil
+}
+
+func TestIpnsRecordEtag(t *testing.T) {
+	mock, root := newMockAPI(t)
+	record := func(value string) []byte {
+		ttl := uint64(time.Minute)
+		b, err := proto.Marshal(&ipns_pb.IpnsEntry{Value: []byte(value), Ttl: &ttl})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	api := &ipnsRecordMockAPI{mockAPI: mock, record: record("/ipfs/" + root.String())}
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := peer.ToCid(pid).String()
+	mock.namesys["/ipns/"+name] = path.FromCid(root)
+
+	get := func(inm string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipns/"+name+"?format=ipns-record", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("")
+	etag := res.Header.Get("Etag")
+	if res.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an Etag, got %d %q", res.StatusCode, etag)
+	}
+	if res := get(etag); res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304 for unchanged record, got %d", res.StatusCode)
+	} else if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("expected 304 to carry Cache-Control, got %q", cc)
+	}
+
+	// Republishing changes the record bytes, and the Etag with them
+	api.record = record("/ipfs/" + root.String() + "/EmptyDir")
+	if res := get(etag); res.StatusCode != http.StatusOK || res.Header.Get("Etag") == etag {
+		t.Errorf("expected 200 with a new Etag for a changed record, got %d %q", res.StatusCode, res.Header.Get("Etag"))
+	}
+}
+
+func TestIpnsRecordJSON(t *testing.T) {
+	mock, root := newMockAPI(t)
+	ttl := uint64(time.Minute)
+	seq := uint64(7)
+	eol := ipns_pb.IpnsEntry_EOL
+	rawRecord, err := proto.Marshal(&ipns_pb.IpnsEntry{
+		Value:        []byte("/ipfs/" + root.String()),
+		ValidityType: &eol,
+		Validity:     []byte("2030-01-02T03:04:05Z"),
+		Sequence:     &seq,
+		Ttl:          &ttl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithConfig(t, &ipnsRecordMockAPI{mockAPI: mock, record: rawRecord}, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	sk, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := peer.ToCid(pid).String()
+	mock.namesys["/ipns/"+name] = path.FromCid(root)
+
+	for _, test := range []struct {
+		query       string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"?format=ipns-record-json", "", "application/vnd.ipfs.ipns-record+json", `{"sequence":7,"validity":"2030-01-02T03:04:05Z","ttl":60,"value":"/ipfs/` + root.String() + `"}`},
+		{"", "application/vnd.ipfs.ipns-record+json", "application/vnd.ipfs.ipns-record+json", `{"sequence":7,"validity":"2030-01-02T03:04:05Z","ttl":60,"value":"/ipfs/` + root.String() + `"}`},
+		{"?format=ipns-record", "", "application/vnd.ipfs.ipns-record", string(rawRecord)},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipns/"+name+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s%s: expected 200, got %d: %s", test.query, test.accept, res.StatusCode, body)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s%s: expected Content-Type %q, got %q", test.query, test.accept, test.contentType, ct)
+		}
+		if string(body) != test.body {
+			t.Errorf("%s%s: expected %q, got %q", test.query, test.accept, test.body, body)
+		}
+	}
+}
+
+func TestIpnsRecordSubpath(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	name := "k51qzi5uqu5dlvj2baxnqndepeb86cbk3ng7n3i46uzyxzyqj2xjonzllnv0v8"
+	api.namesys["/ipns/"+name] = path.FromCid(root)
+
+	for _, test := range []struct {
+		query  string
+		accept string
+		status int
+	}{
+		{"?format=ipns-record", "", http.StatusBadRequest},
+		{"", "application/vnd.ipfs.ipns-record", http.StatusBadRequest},
+		// another format can be returned for the sub-path instead
+		{"", "application/vnd.ipfs.ipns-record, application/vnd.ipld.raw", http.StatusOK},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipns/"+name+"/TestGatewayGet/fnord"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.status {
+			t.Errorf("%q %q: expected %d, got %d: %s", test.query, test.accept, test.status, res.StatusCode, body)
+		} else if test.status == http.StatusBadRequest && !strings.Contains(string(body), "root of a name") {
+			t.Errorf("expected a clear error, got %q", body)
+		}
+	}
+}
+
+func TestDisableFormatQueryParam(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{DisableFormatQueryParam: true})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		query   string
+		accept  string
+		rawResp bool
+	}{
+		{"?format=raw", "", false},
+		{"", "application/vnd.ipld.raw", true},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String()+"/TestGatewayGet/fnord"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if rawResp := res.Header.Get("Content-Type") == "application/vnd.ipld.raw"; rawResp != test.rawResp {
+			t.Errorf("query %q, accept %q: expected raw response %t, got Content-Type %q", test.query, test.accept, test.rawResp, res.Header.Get("Content-Type"))
+		}
+		if etag := res.Header.Get("Etag"); strings.HasSuffix(etag, `.raw"`) != test.rawResp {
+			t.Errorf("query %q, accept %q: unexpected Etag %q", test.query, test.accept, etag)
+		}
+	}
+
+	// Discovery must not advertise query values that are ignored
+	res, err := http.Get(ts.URL + "/ipfs?formats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), `"format"`) {
+		t.Errorf("expected no ?format values in discovery, got %s", body)
+	}
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestClock(t *testing.T) {
+	api, root := newMockAPI(t)
+	now := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	ts := newTestServerWithConfig(t, api, Config{Clock: fixedClock(now)})
+	t.Logf("test server url: %s", ts.URL)
+
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+
+	res, err := http.Get(ts.URL + "/ipns/example.net/TestGatewayGet/fnord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if lm := res.Header.Get("Last-Modified"); lm != now.Format(http.TimeFormat) {
+		t.Errorf("expected Last-Modified %q from the configured clock, got %q", now.Format(http.TimeFormat), lm)
+	}
+}
+
+func TestUnixFSMetadata(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	mtime := time.Date(2022, time.January, 2, 3, 4, 5, 6, time.UTC)
+	fsData, err := builder.BuildUnixFS(func(b *builder.Builder) {
+		builder.DataType(b, data.Data_File)
+		builder.Permissions(b, 0o600)
+		builder.Mtime(b, func(tb builder.TimeBuilder) {
+			builder.Time(tb, mtime)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := merkledag.NodeWithData(data.EncodeUnixFSData(fsData))
+	if err := api.dagService.Add(context.Background(), nd); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path     string
+		metadata string
+	}{
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", `{"type":"file","size":5}`},
+		{"/ipfs/" + root.String() + "/EmptyDir", `{"type":"directory"}`},
+		{"/ipfs/" + nd.Cid().String(), `{"type":"file","size":0,"mode":384,"mtime":"2022-01-02T03:04:05.000000006Z"}`},
+	} {
+		res, err := http.Get(ts.URL + test.path + "?format=unixfs-metadata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", test.path, res.StatusCode, body)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/vnd.ipfs.unixfs-metadata+json" {
+			t.Errorf("%s: unexpected Content-Type %q", test.path, ct)
+		}
+		if string(body) != test.metadata {
+			t.Errorf("%s: expected %s, got %s", test.path, test.metadata, body)
+		}
+	}
+
+	res, err := http.Get(ts.URL + "/ipfs/" + root.String() + "/missing?format=unixfs-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing path, got %d", res.StatusCode)
+	}
+}
+
+func TestOptionsAdvertisesFormats(t *testing.T) {
+	ts, _, root := newTestServerAndNode(t, nil)
+	t.Logf("test server url: %s", ts.URL)
+
+	req, err := http.NewRequest(http.MethodOptions, ts.URL+"/ipfs/"+root.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := doWithoutRedirect(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	formats := res.Header.Get("X-Ipfs-Accept-Formats")
+	for _, mediaType := range []string{"application/vnd.ipld.car", "application/vnd.ipld.raw", "application/x-tar"} {
+		if !strings.Contains(formats, mediaType) {
+			t.Errorf("expected X-Ipfs-Accept-Formats to list %s, got %q", mediaType, formats)
+		}
+	}
+}
+
+func TestImmutableCacheControl(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{ImmutableCacheControl: "public, max-age=3600"})
+	t.Logf("test server url: %s", ts.URL)
+
+	res, err := http.Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=3600" {
+		t.Errorf("expected configured Cache-Control, got %q", cc)
+	}
+}
+
+func TestMounts(t *testing.T) {
+	api, _ := newMockAPI(t)
+	docs := api.addTestDirectory(t, map[string]string{
+		"index.html":    "docs",
+		"api/page.html": "docs api",
+	})
+	apiDocs := api.addTestDirectory(t, map[string]string{
+		"page.html": "api dataset",
+	})
+	ts := httptest.NewServer(NewHandler(Config{Mounts: map[string]cid.Cid{
+		"/docs":     docs,
+		"/docs/api": apiDocs,
+	}}, api))
+	t.Cleanup(func() { ts.Close() })
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/docs/index.html", http.StatusOK, "docs"},
+		{"/docs/api/page.html", http.StatusOK, "api dataset"},
+		{"/docsx/index.html", http.StatusInternalServerError, ""},
+		{"/ipfs/" + docs.String() + "/api/page.html", http.StatusOK, "docs api"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get(ts.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, res.StatusCode)
+			}
+			if test.body == "" {
+				return
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.body {
+				t.Errorf("expected body %q, got %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestResolveLogicalRoots(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+	contentPath := "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+
+	roots, err := ResolveLogicalRoots(context.Background(), api, contentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 3 || roots[0] != root {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+
+	res, err := http.Get(ts.URL + contentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	rootStrs := make([]string, len(roots))
+	for i, c := range roots {
+		rootStrs[i] = c.String()
+	}
+	if hdr := res.Header.Get("X-Ipfs-Roots"); hdr != strings.Join(rootStrs, ",") {
+		t.Errorf("expected X-Ipfs-Roots to match %v, got %q", rootStrs, hdr)
+	}
+
+	if _, err := ResolveLogicalRoots(context.Background(), api, "/ipfs"); err == nil {
+		t.Error("expected an error for an invalid content path")
+	}
+}
+
+// countingBlockstore counts the blocks read from it.
+type countingBlockstore struct {
+	blockstore.Blockstore
+	gets atomic.Int64
+}
+
+func (bs *countingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	bs.gets.Add(1)
+	return bs.Blockstore.Get(ctx, c)
+}
+
+func TestUnixFSFileMultiRange(t *testing.T) {
+	api, _ := newMockAPI(t)
+
+	// A file spanning several blocks, so that ranges are read from different leaves
+	const chunkSize, leaves = 64, 10
+	content := make([]byte, chunkSize*leaves)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	ls := cidlink.DefaultLinkSystem()
+	ls.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(lnk ipld.Link) error {
+			blk, err := blocks.NewBlockWithCid(buf.Bytes(), lnk.(cidlink.Link).Cid)
+			if err != nil {
+				return err
+			}
+			return api.blockStore.Put(context.Background(), blk)
+		}, nil
+	}
+	lnk, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), fmt.Sprintf("size-%d", chunkSize), &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithConfig(t, api, Config{})
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+lnk.String()+"?filename=data.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-99,200-299")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/byteranges" {
+		t.Fatalf("expected multipart/byteranges, got %q", mediaType)
+	}
+
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	for _, r := range []struct{ start, end int }{{0, 99}, {200, 299}} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, len(content)) {
+			t.Errorf("unexpected Content-Range %q", cr)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, content[r.start:r.end+1]) {
+			t.Errorf("unexpected content for range %d-%d", r.start, r.end)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected two parts, got %v", err)
+	}
+}
+
+func TestUnixFSFileRangeSeeksDAG(t *testing.T) {
+	api, _ := newMockAPI(t)
+
+	const chunkSize, leaves = 256, 2000
+	content := make([]byte, chunkSize*leaves)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	ls := cidlink.DefaultLinkSystem()
+	ls.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(lnk ipld.Link) error {
+			blk, err := blocks.NewBlockWithCid(buf.Bytes(), lnk.(cidlink.Link).Cid)
+			if err != nil {
+				return err
+			}
+			return api.blockStore.Put(context.Background(), blk)
+		}, nil
+	}
+	lnk, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), fmt.Sprintf("size-%d", chunkSize), &ls)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Count the blocks fetched while reading the file
+	counting := &countingBlockstore{Blockstore: api.blockStore}
+	api.dagService = merkledag.NewDAGService(blockservice.New(counting, offline.Exchange(counting)))
+	ts := newTestServerWithConfig(t, api, Config{})
+
+	start, end := len(content)-3*chunkSize/2, len(content)-chunkSize/2-1
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+lnk.String()+"?filename=data.bin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", res.StatusCode)
+	}
+	if !bytes.Equal(body, content[start:end+1]) {
+		t.Fatal("unexpected range content")
+	}
+	// The root, the path down to the range and the readahead of the DAG
+	// reader, rather than every leaf before the range
+	if gets := counting.gets.Load(); gets > 10 {
+		t.Errorf("expected only the blocks around the range to be fetched, got %d of %d leaves", gets, leaves)
+	}
+}
+
+// steppingClock advances by step every time it is read.
+type steppingClock struct {
+	lk   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *steppingClock) Now() time.Time {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func TestSlowRequestThreshold(t *testing.T) {
+	if err := logging.SetLogLevel("core/server", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = logging.SetLogLevel("core/server", "error") })
+	reader := logging.NewPipeReader()
+	t.Cleanup(func() { reader.Close() })
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			default:
+			}
+		}
+	}()
+
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{
+		Clock:                &steppingClock{step: time.Second},
+		SlowRequestThreshold: time.Millisecond,
+	})
+
+	res, err := http.Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord?format=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "slow request") {
+				if !strings.Contains(line, "/TestGatewayGet/fnord") || !strings.Contains(line, "application/vnd.ipld.raw") {
+					t.Errorf("expected path and format in %s", line)
+				}
+				if !strings.Contains(line, "HTTP/1.1") {
+					t.Errorf("expected connection protocol in %s", line)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the slow request warning")
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	entries := make(chan AccessLogEntry, 1)
+	api, root := newMockAPI(t)
+	ts := httptest.NewTLSServer(NewHandler(Config{
+		AccessLog: func(e AccessLogEntry) { entries <- e },
+	}, api))
+	t.Cleanup(ts.Close)
+
+	res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord?format=raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	select {
+	case e := <-entries:
+		e.Duration = 0
+		want := AccessLogEntry{
+			Method:         http.MethodGet,
+			Path:           "/ipfs/" + root.String() + "/TestGatewayGet/fnord",
+			Format:         "application/vnd.ipld.raw",
+			Status:         http.StatusOK,
+			Proto:          res.Proto,
+			TLSVersion:     res.TLS.Version,
+			TLSCipherSuite: res.TLS.CipherSuite,
+		}
+		if e != want {
+			t.Errorf("expected %+v, got %+v", want, e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the access log entry")
+	}
+}
+
+func TestIndexEarlyHints(t *testing.T) {
+	api, _ := newMockAPI(t)
+	site := api.addTestDirectory(t, map[string]string{
+		"index.html": `<!DOCTYPE html><html><head>
+<link rel="stylesheet" href="style.css">
+<link rel="stylesheet" href="https://cdn.example.net/remote.css">
+<script src="/app.js"></script>
+<script type="module" src="mod.js"></script>
+</head><body><script src="late.js"></script></body></html>`,
+		"plain/index.html": `<html><body>no subresources</body></html>`,
+	})
+	ts := newTestServerWithConfig(t, api, Config{IndexEarlyHints: true})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path  string
+		links []string
+	}{
+		{"/", []string{
+			"<style.css>; rel=preload; as=style",
+			"</app.js>; rel=preload; as=script",
+			"<mod.js>; rel=modulepreload; as=script",
+		}},
+		{"/plain/", nil},
+	} {
+		var hints []http.Header
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, http.Header(header))
+				}
+				return nil
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, ts.URL+"/ipfs/"+site.String()+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The index is served in full after being parsed
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(body), "<") {
+			t.Fatalf("%s: expected 200 with the index, got %d: %s", test.path, res.StatusCode, body)
+		}
+		if test.links == nil {
+			if len(hints) != 0 {
+				t.Errorf("%s: expected no early hints, got %v", test.path, hints)
+			}
+			continue
+		}
+		if len(hints) != 1 {
+			t.Fatalf("%s: expected one early hints response, got %d", test.path, len(hints))
+		}
+		if links := hints[0].Values("Link"); strings.Join(links, "\n") != strings.Join(test.links, "\n") {
+			t.Errorf("%s: expected Link headers %q, got %q", test.path, test.links, links)
+		}
+	}
+}
+
+func TestGenericServerErrors(t *testing.T) {
+	api, root := newMockAPI(t)
+
+	for _, test := range []struct {
+		generic bool
+		body    string
+	}{
+		{true, "Internal Server Error\n"},
+		{false, "could not resolve name"},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{GenericServerErrors: test.generic})
+
+		res, err := http.Get(ts.URL + "/ipns/nxdomain.example.com/" + root.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected 500, got %d", res.StatusCode)
+		}
+		if !test.generic && !strings.Contains(string(body), test.body) || test.generic && string(body) != test.body {
+			t.Errorf("GenericServerErrors=%t: unexpected body %q", test.generic, body)
+		}
+	}
+}
+
+func TestMissingDNSLinkNotFound(t *testing.T) {
+	api, _ := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{MissingDNSLinkNotFound: true})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/ipns/nxdomain.example.com", http.StatusNotFound},
+		{"/ipns/nxdomain.example.com/index.html", http.StatusNotFound},
+		// not a DNSLink name, the IPNS record could not be found
+		{"/ipns/k51qzi5uqu5djucgtwlxrbfiyfez1nb0ct58q5s4owg6se02evza05dfgi6tw5", http.StatusInternalServerError},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, res.StatusCode)
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	file := "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+	for _, test := range []struct {
+		path   string
+		accept string
+		vary   string
+	}{
+		{file, "", "Prefer, Accept"},
+		{file, "application/vnd.ipld.raw", "Prefer, Accept"},
+		{file + "?format=raw", "", "Prefer"},
+		{file + "?format=car", "application/vnd.ipld.raw", "Prefer"},
+		{file + "?format=unknown", "", "Prefer, Accept"},
+		{"/ipfs/" + root.String() + "/TestGatewayGet/", "", "Prefer, Accept"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if vary := strings.Join(res.Header.Values("Vary"), ", "); vary != test.vary {
+			t.Errorf("%s (Accept %q): expected Vary %q, got %q", test.path, test.accept, test.vary, vary)
+		}
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	api, _ := newMockAPI(t)
+	v1 := api.addTestDirectory(t, map[string]string{"file.txt": "v1"})
+	v2 := api.addTestDirectory(t, map[string]string{"file.txt": "v2"})
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	api.namesys["/ipns/example.net"] = path.FromCid(v1)
+
+	get := func(ifMatch string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipns/example.net/file.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	etag := get("").Header.Get("Etag")
+	if res := get(etag); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for a matching If-Match, got %d", res.StatusCode)
+	}
+
+	// The name is republished underneath the client
+	api.namesys["/ipns/example.net"] = path.FromCid(v2)
+	if res := get(etag); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected 412 once the content changed, got %d", res.StatusCode)
+	}
+	if res := get("*"); res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 for If-Match: *, got %d", res.StatusCode)
+	}
+}
+
+func TestDirSort(t *testing.T) {
+	api, _ := newMockAPI(t)
+	dir := api.addTestDirectory(t, map[string]string{
+		"b.txt":     "b",
+		"a.txt":     "aaaaaaaa",
+		"c.txt":     "cccc",
+		"sub/z.txt": "z",
+	})
+
+	for _, test := range []struct {
+		order DirSort
+		names []string
+	}{
+		{DirSortName, []string{"a.txt", "b.txt", "c.txt", "sub"}},
+		{DirSortDirsFirst, []string{"sub", "a.txt", "b.txt", "c.txt"}},
+		{DirSortSizeDesc, []string{"sub", "a.txt", "c.txt", "b.txt"}},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{DirSort: test.order})
+
+		res, err := http.Get(ts.URL + "/ipfs/" + dir.String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := -1
+		for _, name := range test.names {
+			idx := strings.Index(string(body), ">"+name+"</a>")
+			if idx < 0 {
+				t.Fatalf("DirSort %d: %q is not listed", test.order, name)
+			}
+			if idx < last {
+				t.Errorf("DirSort %d: expected %q to be listed in order %v", test.order, name, test.names)
+			}
+			last = idx
+		}
+	}
+}
+
+func TestDirListingEtag(t *testing.T) {
+	api, root := newMockAPI(t)
+	dirPath := "/ipfs/" + root.String() + "/TestGatewayGet/"
+
+	var etags []string
+	for _, order := range []DirSort{DirSortName, DirSortSizeDesc} {
+		ts := newTestServerWithConfig(t, api, Config{DirSort: order})
+
+		res, err := http.Get(ts.URL + dirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		etag := res.Header.Get("Etag")
+		if !strings.Contains(etag, assets.AssetHash) {
+			t.Errorf("expected the listing Etag to include the template version, got %q", etag)
+		}
+		etags = append(etags, etag)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+dirPath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-None-Match", etag)
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("expected 304 for a matching listing Etag, got %d", res.StatusCode)
+		}
+	}
+
+	if etags[0] == etags[1] {
+		t.Errorf("expected listings in different orders to have different Etags, got %q", etags[0])
+	}
+}
+
+func TestMaxIpfsRootsHeaderBytes(t *testing.T) {
+	api, root := newMockAPI(t)
+	contentPath := "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+	roots, err := ResolveLogicalRoots(context.Background(), api, contentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootStrs := make([]string, len(roots))
+	for i, c := range roots {
+		rootStrs[i] = c.String()
+	}
+	full := strings.Join(rootStrs, ",")
+
+	for _, test := range []struct {
+		limit     int
+		roots     string
+		truncated bool
+	}{
+		{0, full, false},
+		{len(full), full, false},
+		{len(full) - 1, strings.Join(rootStrs[1:], ","), true},
+		{1, rootStrs[len(rootStrs)-1], true},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{MaxIpfsRootsHeaderBytes: test.limit})
+
+		res, err := http.Get(ts.URL + contentPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if hdr := res.Header.Get("X-Ipfs-Roots"); hdr != test.roots {
+			t.Errorf("limit %d: expected X-Ipfs-Roots %q, got %q", test.limit, test.roots, hdr)
+		}
+		if truncated := res.Header.Get("X-Ipfs-Roots-Truncated") == "true"; truncated != test.truncated {
+			t.Errorf("limit %d: expected truncated=%t", test.limit, test.truncated)
+		}
+	}
+}
+
+func TestMethodPreservingRedirects(t *testing.T) {
+	api, root := newMockAPI(t)
+
+	for _, test := range []struct {
+		preserve bool
+		status   int
+	}{
+		{false, http.StatusMovedPermanently},
+		{true, http.StatusPermanentRedirect},
+	} {
+		ts := newTestServerWithConfig(t, api, Config{MethodPreservingRedirects: test.preserve})
+
+		for _, p := range []string{
+			"/ipfs/?uri=ipfs://" + root.String(),
+			"/ipfs/" + root.String() + "/TestGatewayGet",
+		} {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := doWithoutRedirect(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != test.status {
+				t.Errorf("%s (MethodPreservingRedirects=%t): expected %d, got %d", p, test.preserve, test.status, res.StatusCode)
+			}
+		}
+	}
+}
+
+func TestCodecMatrix(t *testing.T) {
+	api, _ := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	// The same {"a":1} document in each serialization
+	jsonData := []byte(`{"a":1}`)
+	cborData := []byte{0xa1, 0x61, 'a', 0x01}
+	put := func(codec mc.Code, data []byte) cid.Cid {
+		c, err := cid.Prefix{Version: 1, Codec: uint64(codec), MhType: multihash.SHA2_256, MhLength: -1}.Sum(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := api.blockStore.Put(context.Background(), blk); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	codecCids := map[mc.Code]cid.Cid{
+		mc.Json:    put(mc.Json, jsonData),
+		mc.Cbor:    put(mc.Cbor, cborData),
+		mc.DagJson: put(mc.DagJson, jsonData),
+		mc.DagCbor: put(mc.DagCbor, cborData),
+	}
+
+	for _, test := range []struct {
+		codec       mc.Code
+		format      string
+		status      int
+		contentType string
+		body        []byte
+	}{
+		{mc.Json, "json", http.StatusOK, "application/json", jsonData},
+		{mc.Json, "cbor", http.StatusNotAcceptable, "", nil},
+		{mc.Json, "dag-json", http.StatusOK, "application/json", jsonData},
+		{mc.Json, "dag-cbor", http.StatusNotAcceptable, "", nil},
+		{mc.Cbor, "json", http.StatusNotAcceptable, "", nil},
+		{mc.Cbor, "cbor", http.StatusOK, "application/cbor", cborData},
+		{mc.Cbor, "dag-json", http.StatusNotAcceptable, "", nil},
+		{mc.Cbor, "dag-cbor", http.StatusOK, "application/cbor", cborData},
+		{mc.DagJson, "json", http.StatusOK, "application/json", jsonData},
+		{mc.DagJson, "cbor", http.StatusNotAcceptable, "", nil},
+		{mc.DagJson, "dag-json", http.StatusOK, "application/vnd.ipld.dag-json", jsonData},
+		{mc.DagJson, "dag-cbor", http.StatusOK, "application/vnd.ipld.dag-cbor", cborData},
+		{mc.DagCbor, "json", http.StatusNotAcceptable, "", nil},
+		{mc.DagCbor, "cbor", http.StatusOK, "application/cbor", cborData},
+		{mc.DagCbor, "dag-json", http.StatusOK, "application/vnd.ipld.dag-json", jsonData},
+		{mc.DagCbor, "dag-cbor", http.StatusOK, "application/vnd.ipld.dag-cbor", cborData},
+	} {
+		name := test.codec.String() + " as " + test.format
+		res, err := http.Get(ts.URL + "/ipfs/" + codecCids[test.codec].String() + "?format=" + test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d: %s", name, test.status, res.StatusCode, body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if ct := res.Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", name, test.contentType, ct)
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: expected body %q, got %q", name, test.body, body)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	api, _ := newMockAPI(t)
+	root := api.addTestDirectory(t, map[string]string{
+		"a/page.html": "page",
+	})
+	// Served without a mux, which would redirect unclean paths on its own
+	ts := httptest.NewServer(NewHandler(Config{NormalizePath: true}, api))
+	t.Cleanup(func() { ts.Close() })
+
+	rootPath := "/ipfs/" + root.String()
+	for _, test := range []struct {
+		path     string
+		ipfsPath string
+	}{
+		{rootPath + "/a/page.html", rootPath + "/a/page.html"},
+		{rootPath + "//a/./page.html", rootPath + "/a/page.html"},
+		{rootPath + "/b/../a/page.html", rootPath + "/a/page.html"},
+		{rootPath + "/../../a/page.html", rootPath + "/a/page.html"},
+		{rootPath + "/a//", rootPath + "/a/"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			res, err := http.Get(ts.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+			if ipfsPath := res.Header.Get("X-Ipfs-Path"); ipfsPath != test.ipfsPath {
+				t.Errorf("expected X-Ipfs-Path %q, got %q", test.ipfsPath, ipfsPath)
+			}
+		})
+	}
+}
+
+func TestReprDigest(t *testing.T) {
+	api, _ := newMockAPI(t)
+	root := api.addTestDirectory(t, map[string]string{"raw.txt": "raw leaf"})
+	pbFile := merkledag.NodeWithData(unixfs.FilePBData([]byte("dag-pb file"), uint64(len("dag-pb file"))))
+	if err := api.dagService.Add(context.Background(), pbFile); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		maxSize int64
+		path    string
+		digest  bool
+	}{
+		{"raw leaf file", 0, "/ipfs/" + root.String() + "/raw.txt", true},
+		{"sha2-256 block", 0, "/ipfs/" + root.String() + "?format=raw", true},
+		{"dag-pb file", 0, "/ipfs/" + pbFile.Cid().String(), false},
+		{"hashed dag-pb file", 1024, "/ipfs/" + pbFile.Cid().String(), true},
+		{"dag-pb file over max size", 4, "/ipfs/" + pbFile.Cid().String(), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServerWithConfig(t, api, Config{ReprDigestMaxSize: test.maxSize})
+			res, err := http.Get(ts.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+
+			digest := res.Header.Get("Repr-Digest")
+			if !test.digest {
+				if digest != "" {
+					t.Errorf("expected no Repr-Digest, got %q", digest)
+				}
+				return
+			}
+			sum := sha256.Sum256(body)
+			if expected := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"; digest != expected {
+				t.Errorf("expected Repr-Digest %q, got %q", expected, digest)
+			}
+		})
+	}
+}
+
+func TestResolveFormat(t *testing.T) {
+	api, _ := newMockAPI(t)
+	root := api.addTestDirectory(t, map[string]string{"a": "content"})
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+	ts := newTestServerWithConfig(t, api, Config{})
+	t.Logf("test server url: %s", ts.URL)
+
+	// Only the path is resolved, so content that is gone doesn't matter
+	nd, err := api.dagService.Get(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := nd.Links()[0].Cid
+	if err := api.blockStore.DeleteBlock(context.Background(), leaf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path   string
+		header map[string]string
+		status int
+		body   string
+	}{
+		{"/ipfs/" + root.String() + "/a", nil, http.StatusOK, `{"cid":"` + leaf.String() + `","path":"/ipfs/` + root.String() + `/a"}`},
+		{"/ipns/example.net/a", nil, http.StatusOK, `{"cid":"` + leaf.String() + `","path":"/ipns/example.net/a"}`},
+		{"/ipfs/" + root.String() + "/missing", nil, http.StatusNotFound, ""},
+		{"/ipfs/" + root.String() + "/a", map[string]string{"Cache-Control": "only-if-cached"}, http.StatusPreconditionFailed, ""},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+test.path+"?format=resolve", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range test.header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d: %s", test.path, test.status, res.StatusCode, body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/vnd.ipfs.resolve+json" {
+			t.Errorf("%s: unexpected Content-Type %q", test.path, ct)
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: expected %s, got %s", test.path, test.body, body)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{AllowedHosts: []string{"gateway.example.com", "*.example.net"}})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		host   string
+		status int
+	}{
+		{"gateway.example.com", http.StatusOK},
+		{"Gateway.Example.com:8080", http.StatusOK},
+		{"site.example.net", http.StatusOK},
+		{"a.site.example.net", http.StatusOK},
+		{"example.net", http.StatusMisdirectedRequest},
+		{"evil.example.com", http.StatusMisdirectedRequest},
+		{"gateway.example.com.evil.org", http.StatusMisdirectedRequest},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+root.String()+"/TestGatewayGet/fnord", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = test.host
+		res, err := doWithoutRedirect(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.host, test.status, res.StatusCode)
+		}
+	}
+}
+
+func TestRobotsTxt(t *testing.T) {
+	api, _ := newMockAPI(t)
+
+	for _, test := range []struct {
+		name   string
+		robots []byte
+		status int
+		body   string
+	}{
+		{"default", nil, http.StatusOK, DefaultRobotsTxt},
+		{"custom", []byte("User-agent: *\nDisallow: /\n"), http.StatusOK, "User-agent: *\nDisallow: /\n"},
+		{"disabled", []byte{}, http.StatusInternalServerError, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// robots.txt is only served when the handler is mounted at /
+			ts := httptest.NewServer(NewHandler(Config{RobotsTxt: test.robots}, api))
+			t.Cleanup(func() { ts.Close() })
+
+			res, err := http.Get(ts.URL + "/robots.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d: %s", test.status, res.StatusCode, body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			if string(body) != test.body {
+				t.Errorf("expected %q, got %q", test.body, body)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Errorf("unexpected Content-Type %q", ct)
+			}
+		})
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	api, _ := newMockAPI(t)
+	site := api.addTestDirectory(t, map[string]string{
+		"index.html":          "home",
+		"about.html":          "about",
+		"logo.png":            "png",
+		"blog/index.html":     "blog",
+		"blog/post.htm":       "post",
+		"blog/deep/page.html": "deep",
+	})
+	withSitemap := api.addTestDirectory(t, map[string]string{
+		"index.html":  "home",
+		"sitemap.xml": "own sitemap",
+	})
+	api.namesys["/ipns/example.net"] = path.FromCid(site)
+	api.namesys["/ipns/own.example.net"] = path.FromCid(withSitemap)
+
+	all := []string{"/", "/about.html", "/blog/", "/blog/post.htm", "/blog/deep/page.html"}
+	for _, test := range []struct {
+		name   string
+		config Config
+		host   string
+		status int
+		locs   []string
+	}{
+		{"disabled", Config{}, "example.net", http.StatusNotFound, nil},
+		{"all pages", Config{SitemapMaxEntries: 100}, "example.net", http.StatusOK, all},
+		{"max depth", Config{SitemapMaxEntries: 100, SitemapMaxDepth: 1}, "example.net", http.StatusOK, all[:4]},
+		// the entries of the root are all visited, but none of blog/
+		{"max entries", Config{SitemapMaxEntries: 4}, "example.net", http.StatusOK, all[:2]},
+		{"site sitemap", Config{SitemapMaxEntries: 100}, "own.example.net", http.StatusOK, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServerWithConfig(t, api, test.config)
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/sitemap.xml", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = test.host
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.status {
+				t.Fatalf("expected %d, got %d", test.status, res.StatusCode)
+			}
+			if test.locs == nil {
+				if strings.Contains(string(body), "<urlset") {
+					t.Errorf("expected no generated sitemap, got %s", body)
+				}
+				return
+			}
+
+			var set struct {
+				Locs []string `xml:"url>loc"`
+			}
+			if err := xml.Unmarshal(body, &set); err != nil {
+				t.Fatal(err)
+			}
+			want := make([]string, len(test.locs))
+			for j, loc := range test.locs {
+				want[j] = "http://" + test.host + loc
+			}
+			sort.Strings(want)
+			sort.Strings(set.Locs)
+			if strings.Join(set.Locs, " ") != strings.Join(want, " ") {
+				t.Errorf("expected %v, got %v", want, set.Locs)
+			}
+		})
+	}
+}
+
+func TestListingStrings(t *testing.T) {
+	api, _ := newMockAPI(t)
+	dir := api.addTestDirectory(t, map[string]string{"a.txt": "a"})
+	ts := newTestServerWithConfig(t, api, Config{
+		ListingStrings: map[string]map[string]string{
+			"fr":    {"index-of": "Index de"},
+			"pt-BR": {"index-of": "Índice de"},
+		},
+	})
+
+	etags := map[string]bool{}
+	for _, test := range []struct {
+		acceptLanguage string
+		lang           string
+		indexOf        string
+	}{
+		{"", "en", "Index of"},
+		{"de", "en", "Index of"},
+		{"fr-CA", "fr", "Index de"},
+		{"de, pt-br;q=0.8, fr;q=0.5", "pt-BR", "Índice de"},
+		{"fr;q=0, en", "en", "Index of"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/"+dir.String()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Language", test.acceptLanguage)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(body), `<html lang="`+test.lang+`">`) || !strings.Contains(string(body), test.indexOf) {
+			t.Errorf("Accept-Language %q: expected a listing in %s", test.acceptLanguage, test.lang)
+		}
+		// untranslated texts stay in English
+		if !strings.Contains(string(body), "About IPFS") {
+			t.Errorf("Accept-Language %q: expected English fallback texts", test.acceptLanguage)
+		}
+		if !strings.Contains(strings.Join(res.Header.Values("Vary"), ", "), "Accept-Language") {
+			t.Errorf("Accept-Language %q: expected Vary: Accept-Language", test.acceptLanguage)
+		}
+		etags[test.lang+" "+res.Header.Get("Etag")] = true
+	}
+	if len(etags) != 3 {
+		t.Errorf("expected one Etag per language, got %v", etags)
+	}
+}
+
+func TestIndexFileNames(t *testing.T) {
+	api, _ := newMockAPI(t)
+	both := api.addTestDirectory(t, map[string]string{
+		"index.html": "html",
+		"index.htm":  "htm",
+	})
+	legacy := api.addTestDirectory(t, map[string]string{
+		"index.htm": "htm",
+	})
+
+	for _, test := range []struct {
+		name  string
+		names []string
+		dir   cid.Cid
+		body  string
+	}{
+		{"default", nil, both, "html"},
+		{"default without index.html", nil, legacy, ""},
+		{"priority", []string{"index.htm", "index.html"}, both, "htm"},
+		{"fallback", []string{"index.html", "index.htm"}, legacy, "htm"},
+		{"disabled", []string{}, both, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServerWithConfig(t, api, Config{IndexFileNames: test.names})
+			res, err := http.Get(ts.URL + "/ipfs/" + test.dir.String() + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d", res.StatusCode)
+			}
+
+			if test.body == "" {
+				// The generated listing links the entries
+				if !strings.Contains(string(body), ">index.htm</a>") {
+					t.Errorf("expected a directory listing, got %q", body)
+				}
+			} else if string(body) != test.body {
+				t.Errorf("expected %q, got %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestServePlan(t *testing.T) {
+	api, root := newMockAPI(t)
+	filePath := "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+
+	// Without Debug the parameter is ignored
+	ts := newTestServerWithConfig(t, api, Config{})
+	res, err := http.Get(ts.URL + filePath + "?debug=serve-plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "fnord" {
+		t.Errorf("expected the content without Debug, got %q", body)
+	}
+
+	ts = newTestServerWithConfig(t, api, Config{Debug: true})
+	for _, test := range []struct {
+		query   string
+		format  string
+		handler string
+	}{
+		{"", "", "unixfs"},
+		{"&format=raw", "application/vnd.ipld.raw", "raw block"},
+		{"&format=car", "application/vnd.ipld.car", "car stream"},
+	} {
+		res, err := http.Get(ts.URL + filePath + "?debug=serve-plan" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan servePlan
+		err = json.NewDecoder(res.Body).Decode(&plan)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", test.query, res.StatusCode)
+		}
+		if cc := res.Header.Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("%s: expected the plan not to be cached, got Cache-Control %q", test.query, cc)
+		}
+		if plan.ContentPath != filePath || plan.ResponseFormat != test.format || plan.Handler != test.handler {
+			t.Errorf("%s: unexpected plan %+v", test.query, plan)
+		}
+		if plan.Cid == "" || plan.Headers.Get("X-Ipfs-Path") != filePath {
+			t.Errorf("%s: expected the resolved CID and computed headers, got %+v", test.query, plan)
+		}
+	}
+}
+
+func TestDNSLinkResolver(t *testing.T) {
+	api, root := newMockAPI(t)
+	var lookups []string
+	ts := newTestServerWithConfig(t, api, Config{
+		MissingDNSLinkNotFound: true,
+		DNSLinkResolver: func(ctx context.Context, name string) (ipath.Path, error) {
+			lookups = append(lookups, name)
+			if name == "example.com" {
+				return ipath.IpfsPath(root), nil
+			}
+			return nil, fmt.Errorf("no DNSLink for %s: %w", name, namesys.ErrResolveFailed)
+		},
+	})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		path   string
+		status int
+	}{
+		{"/ipns/example.com/TestGatewayGet/fnord", http.StatusOK},
+		{"/ipns/missing.example.com/TestGatewayGet/fnord", http.StatusNotFound},
+	} {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, res.StatusCode)
+		}
+	}
+	if len(lookups) == 0 || lookups[0] != "example.com" {
+		t.Errorf("expected the DNSLink resolver to be used, got lookups %v", lookups)
+	}
+}
@@ -2,32 +2,44 @@ package gateway
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	gopath "path"
 	"regexp"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-libipfs/blocks"
 	logging "github.com/ipfs/go-log"
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-namesys"
 	"github.com/ipfs/go-path/resolver"
+	ufs "github.com/ipfs/go-unixfs"
+	ufspb "github.com/ipfs/go-unixfs/pb"
 	coreiface "github.com/ipfs/interface-go-ipfs-core"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	mc "github.com/multiformats/go-multicodec"
 	prometheus "github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 )
 
 var log = logging.Logger("core/server")
@@ -39,11 +51,16 @@ const (
 )
 
 var (
-	onlyASCII = regexp.MustCompile("[[:^ascii:]]")
-	noModtime = time.Unix(0, 0) // disables Last-Modified header if passed as modtime
+	onlyASCII    = regexp.MustCompile("[[:^ascii:]]")
+	asciiControl = regexp.MustCompile("[[:cntrl:]]")
+	noModtime    = time.Unix(0, 0) // disables Last-Modified header if passed as modtime
 
 	ErrGatewayTimeout = errors.New(http.StatusText(http.StatusGatewayTimeout))
 	ErrBadGateway     = errors.New(http.StatusText(http.StatusBadGateway))
+
+	// ErrMaxTraversalDepth is returned when a CAR or TAR response goes
+	// deeper into the DAG than allowed by Config.MaxTraversalDepth.
+	ErrMaxTraversalDepth = errors.New("maximum DAG traversal depth exceeded")
 )
 
 // HTML-based redirect for errors which can be recovered from, but we want
@@ -72,7 +89,27 @@ type handler struct {
 	config Config
 	api    API
 
+	// requests being served, tracked so that Drain can wait for them
+	drainLk  sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+
+	// sitemap paths by root CID, see Config.SitemapMaxEntries
+	sitemaps *lru.Cache
+
+	// paths being resolved again in the background, see
+	// Config.StaleWhileRevalidate
+	revalidateLk sync.Mutex
+	revalidating map[string]struct{}
+
+	// admission bounds concurrent requests, nil when unlimited
+	admission *semaphore.Weighted
+
 	// generic metrics
+	requestsInFlightMetric     *prometheus.GaugeVec
+	requestsQueuedMetric       *prometheus.GaugeVec
+	panicsMetric               *prometheus.CounterVec
+	onlyIfCachedMetric         *prometheus.CounterVec
 	firstContentBlockGetMetric *prometheus.HistogramVec
 	unixfsGetMetric            *prometheus.SummaryVec // deprecated, use firstContentBlockGetMetric
 
@@ -86,6 +123,8 @@ type handler struct {
 	tarStreamGetMetric           *prometheus.HistogramVec
 	jsoncborDocumentGetMetric    *prometheus.HistogramVec
 	ipnsRecordGetMetric          *prometheus.HistogramVec
+	unixfsMetadataGetMetric      *prometheus.HistogramVec
+	resolveGetMetric             *prometheus.HistogramVec
 }
 
 // StatusResponseWriter enables us to override HTTP Status Code passed to
@@ -93,6 +132,8 @@ type handler struct {
 // presence of HTTP Headers such as Location.
 type statusResponseWriter struct {
 	http.ResponseWriter
+	// redirectCode replaces 200 when a redirect is scheduled
+	redirectCode int
 }
 
 // Custom type for collecting error details to be handled by `webRequestError`
@@ -119,12 +160,106 @@ func (sw *statusResponseWriter) WriteHeader(code int) {
 	// tools which do not follow redirects by default (curl, wget).
 	redirect := sw.ResponseWriter.Header().Get("Location")
 	if redirect != "" && code == http.StatusOK {
-		code = http.StatusMovedPermanently
+		code = sw.redirectCode
 		log.Debugw("subdomain redirect", "location", redirect, "status", code)
 	}
 	sw.ResponseWriter.WriteHeader(code)
 }
 
+// panicRecoveryResponseWriter records whether the response status was
+// already sent, so that a recovered panic only writes an error response
+// when it still can.
+type panicRecoveryResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *panicRecoveryResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if code >= 200 {
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *panicRecoveryResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *panicRecoveryResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *panicRecoveryResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// spanStatusResponseWriter records the outcome of a request on its tracing
+// span: the status code as the http.status_code attribute, and an error
+// status for 5xx responses. Errors replied with webError are recorded too.
+type spanStatusResponseWriter struct {
+	http.ResponseWriter
+	span        trace.Span
+	wroteHeader bool
+	// status of the final response, for Config.AccessLog
+	status int
+}
+
+func (w *spanStatusResponseWriter) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		w.status = code
+		w.span.SetAttributes(attribute.Int("http.status_code", code))
+		if code >= 500 {
+			w.span.SetStatus(codes.Error, http.StatusText(code))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *spanStatusResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *spanStatusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *spanStatusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordSpanError records err on the span of the request w replies to, if
+// w wraps a spanStatusResponseWriter.
+func recordSpanError(w http.ResponseWriter, err error) {
+	for {
+		switch rw := w.(type) {
+		case *spanStatusResponseWriter:
+			rw.span.RecordError(err)
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
 // ServeContent replies to the request using the content in the provided ReadSeeker
 // and returns the status code written and any error encountered during a write.
 // It wraps http.ServeContent which takes care of If-None-Match+Etag,
@@ -142,10 +277,15 @@ func ServeContent(w http.ResponseWriter, req *http.Request, name string, modtime
 }
 
 // errRecordingResponseWriter wraps a ResponseWriter to record the status code and any write error.
+// When writeTimeout is set, every write must complete within it, so that a
+// client that stopped reading can't hold the response open forever. The
+// deadline is set on the connection, so it is always measured with the system
+// clock rather than Config.Clock.
 type errRecordingResponseWriter struct {
 	http.ResponseWriter
-	code int
-	err  error
+	code         int
+	err          error
+	writeTimeout time.Duration
 }
 
 func (w *errRecordingResponseWriter) WriteHeader(code int) {
@@ -156,6 +296,9 @@ func (w *errRecordingResponseWriter) WriteHeader(code int) {
 }
 
 func (w *errRecordingResponseWriter) Write(p []byte) (int, error) {
+	if w.writeTimeout > 0 {
+		w.setWriteDeadline(time.Now().Add(w.writeTimeout))
+	}
 	n, err := w.ResponseWriter.Write(p)
 	if err != nil && w.err == nil {
 		w.err = err
@@ -166,6 +309,11 @@ func (w *errRecordingResponseWriter) Write(p []byte) (int, error) {
 // ReadFrom exposes errRecordingResponseWriter's underlying ResponseWriter to io.Copy
 // to allow optimized methods to be taken advantage of.
 func (w *errRecordingResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if w.writeTimeout > 0 {
+		// Copy chunk by chunk so the deadline is renewed on every write
+		// instead of bounding the whole transfer.
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
 	n, err = io.Copy(w.ResponseWriter, r)
 	if err != nil && w.err == nil {
 		w.err = err
@@ -173,7 +321,18 @@ func (w *errRecordingResponseWriter) ReadFrom(r io.Reader) (n int64, err error)
 	return n, err
 }
 
-func newSummaryMetric(name string, help string) *prometheus.SummaryVec {
+func (w *errRecordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying ResponseWriter.
+func (w *errRecordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func newSummaryMetric(name string, help string, extraLabels []string) *prometheus.SummaryVec {
 	summaryMetric := prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Namespace: "ipfs",
@@ -181,7 +340,7 @@ func newSummaryMetric(name string, help string) *prometheus.SummaryVec {
 			Name:      name,
 			Help:      help,
 		},
-		[]string{"gateway"},
+		append([]string{"gateway"}, extraLabels...),
 	)
 	if err := prometheus.Register(summaryMetric); err != nil {
 		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
@@ -193,7 +352,47 @@ func newSummaryMetric(name string, help string) *prometheus.SummaryVec {
 	return summaryMetric
 }
 
-func newHistogramMetric(name string, help string) *prometheus.HistogramVec {
+func newCounterMetric(name string, help string, extraLabels []string) *prometheus.CounterVec {
+	counterMetric := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      name,
+			Help:      help,
+		},
+		append([]string{"gateway"}, extraLabels...),
+	)
+	if err := prometheus.Register(counterMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			counterMetric = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			log.Errorf("failed to register ipfs_http_%s: %v", name, err)
+		}
+	}
+	return counterMetric
+}
+
+func newGaugeMetric(name string, help string, extraLabels []string) *prometheus.GaugeVec {
+	gaugeMetric := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ipfs",
+			Subsystem: "http",
+			Name:      name,
+			Help:      help,
+		},
+		append([]string{"gateway"}, extraLabels...),
+	)
+	if err := prometheus.Register(gaugeMetric); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			gaugeMetric = are.ExistingCollector.(*prometheus.GaugeVec)
+		} else {
+			log.Errorf("failed to register ipfs_http_%s: %v", name, err)
+		}
+	}
+	return gaugeMetric
+}
+
+func newHistogramMetric(name string, help string, extraLabels []string) *prometheus.HistogramVec {
 	// We can add buckets as a parameter in the future, but for now using static defaults
 	// suggested in https://github.com/ipfs/kubo/issues/8441
 	defaultBuckets := []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}
@@ -205,7 +404,7 @@ func newHistogramMetric(name string, help string) *prometheus.HistogramVec {
 			Help:      help,
 			Buckets:   defaultBuckets,
 		},
-		[]string{"gateway"},
+		append([]string{"gateway"}, extraLabels...),
 	)
 	if err := prometheus.Register(histogramMetric); err != nil {
 		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
@@ -217,23 +416,115 @@ func newHistogramMetric(name string, help string) *prometheus.HistogramVec {
 	return histogramMetric
 }
 
+// metricLabels returns the labels for an observation about a request for the
+// given namespace, including the ones from Config.MetricLabelsFunc.
+func (i *handler) metricLabels(r *http.Request, ns string) prometheus.Labels {
+	labels := prometheus.Labels{"gateway": ns}
+	if len(i.config.MetricLabels) == 0 {
+		return labels
+	}
+
+	var custom prometheus.Labels
+	if i.config.MetricLabelsFunc != nil {
+		custom = i.config.MetricLabelsFunc(r)
+	}
+	for _, name := range i.config.MetricLabels {
+		labels[name] = custom[name]
+	}
+	return labels
+}
+
 // NewHandler returns an http.Handler that can act as a gateway to IPFS content
 // offlineApi is a version of the API that should not make network requests for missing data
+//
+// The Config is checked with Config.Validate, and problems are logged as
+// warnings. Call Validate directly to refuse invalid configurations.
+//
+// The returned handler implements Drainer.
 func NewHandler(c Config, api API) http.Handler {
+	if err := c.Validate(); err != nil {
+		log.Warnf("invalid gateway config: %s", err)
+	}
+	if c.WriteTimeout > 0 && !writeDeadlineSupported {
+		log.Warn("gateway WriteTimeout is ignored: write deadlines require Go 1.20 or later")
+	}
 	return newHandler(c, api)
 }
 
+// Drainer is implemented by the handler returned by NewHandler.
+type Drainer interface {
+	// Drain makes the handler reply to new requests with 503 Service
+	// Unavailable, and blocks until the requests being served complete or ctx
+	// is done, for graceful rolling restarts. It returns ctx.Err() in the
+	// latter case. Draining can't be undone.
+	Drain(ctx context.Context) error
+}
+
+// retryAfter is the Retry-After value, in seconds, sent with 503 responses
+// while draining or when over Config.MaxConcurrentRequests.
+const retryAfter = "5"
+
+func (i *handler) Drain(ctx context.Context) error {
+	i.drainLk.Lock()
+	i.draining = true
+	i.drainLk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		i.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func newHandler(c Config, api API) *handler {
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+	if c.BlockFetchRetry.MaxAttempts > 1 {
+		api = &retryingAPI{API: api, policy: c.BlockFetchRetry}
+	}
 	i := &handler{
-		config: c,
-		api:    api,
+		config:       c,
+		api:          api,
+		revalidating: make(map[string]struct{}),
 		// Improved Metrics
 		// ----------------------------
+		// Number of requests currently being served
+		requestsInFlightMetric: newGaugeMetric(
+			"gw_requests_in_flight",
+			"The number of requests currently being handled by the gateway.",
+			c.MetricLabels,
+		),
+		// Number of requests waiting for MaxConcurrentRequests admission
+		requestsQueuedMetric: newGaugeMetric(
+			"gw_requests_queued",
+			"The number of requests waiting to be handled by the gateway.",
+			c.MetricLabels,
+		),
+		// Number of panics recovered from while serving requests
+		panicsMetric: newCounterMetric(
+			"gw_panics_total",
+			"The number of panics recovered from in the gateway handler.",
+			c.MetricLabels,
+		),
+		// Only-if-cached requests, by whether the content was cached locally
+		onlyIfCachedMetric: newCounterMetric(
+			"gw_only_if_cached_total",
+			"The number of only-if-cached requests, by result (hit or miss).",
+			append([]string{"result"}, c.MetricLabels...),
+		),
 		// Time till the first content block (bar in /ipfs/cid/foo/bar)
 		// (format-agnostic, across all response types)
 		firstContentBlockGetMetric: newHistogramMetric(
 			"gw_first_content_block_get_latency_seconds",
 			"The time till the first content block is received on GET from the gateway.",
+			c.MetricLabels,
 		),
 
 		// Response-type specific metrics
@@ -242,46 +533,67 @@ func newHandler(c Config, api API) *handler {
 		getMetric: newHistogramMetric(
 			"gw_get_duration_seconds",
 			"The time to GET a successful response to a request (all content types).",
+			c.MetricLabels,
 		),
 		// UnixFS: time it takes to return a file
 		unixfsFileGetMetric: newHistogramMetric(
 			"gw_unixfs_file_get_duration_seconds",
 			"The time to serve an entire UnixFS file from the gateway.",
+			c.MetricLabels,
 		),
 		// UnixFS: time it takes to find and serve an index.html file on behalf of a directory.
 		unixfsDirIndexGetMetric: newHistogramMetric(
 			"gw_unixfs_dir_indexhtml_get_duration_seconds",
 			"The time to serve an index.html file on behalf of a directory from the gateway. This is a subset of gw_unixfs_file_get_duration_seconds.",
+			c.MetricLabels,
 		),
 		// UnixFS: time it takes to generate static HTML with directory listing
 		unixfsGenDirListingGetMetric: newHistogramMetric(
 			"gw_unixfs_gen_dir_listing_get_duration_seconds",
 			"The time to serve a generated UnixFS HTML directory listing from the gateway.",
+			c.MetricLabels,
 		),
 		// CAR: time it takes to return requested CAR stream
 		carStreamGetMetric: newHistogramMetric(
 			"gw_car_stream_get_duration_seconds",
 			"The time to GET an entire CAR stream from the gateway.",
+			c.MetricLabels,
 		),
 		// Block: time it takes to return requested Block
 		rawBlockGetMetric: newHistogramMetric(
 			"gw_raw_block_get_duration_seconds",
 			"The time to GET an entire raw Block from the gateway.",
+			c.MetricLabels,
 		),
 		// TAR: time it takes to return requested TAR stream
 		tarStreamGetMetric: newHistogramMetric(
 			"gw_tar_stream_get_duration_seconds",
 			"The time to GET an entire TAR stream from the gateway.",
+			c.MetricLabels,
 		),
 		// JSON/CBOR: time it takes to return requested DAG-JSON/-CBOR document
 		jsoncborDocumentGetMetric: newHistogramMetric(
 			"gw_jsoncbor_get_duration_seconds",
 			"The time to GET an entire DAG-JSON/CBOR block from the gateway.",
+			c.MetricLabels,
 		),
 		// IPNS Record: time it takes to return IPNS record
 		ipnsRecordGetMetric: newHistogramMetric(
 			"gw_ipns_record_get_duration_seconds",
 			"The time to GET an entire IPNS Record from the gateway.",
+			c.MetricLabels,
+		),
+		// UnixFS metadata: time it takes to return the JSON attributes of a node
+		unixfsMetadataGetMetric: newHistogramMetric(
+			"gw_unixfs_metadata_get_duration_seconds",
+			"The time to GET the UnixFS metadata of a node from the gateway.",
+			c.MetricLabels,
+		),
+		// Resolve: time it takes to resolve a path to the CID it points at
+		resolveGetMetric: newHistogramMetric(
+			"gw_resolve_get_duration_seconds",
+			"The time to resolve a content path to its CID through the gateway.",
+			c.MetricLabels,
 		),
 
 		// Legacy Metrics
@@ -290,25 +602,137 @@ func newHandler(c Config, api API) *handler {
 			// (deprecated, use firstContentBlockGetMetric instead)
 			"unixfs_get_latency_seconds",
 			"DEPRECATED: does not do what you think, use gw_first_content_block_get_latency_seconds instead.",
+			c.MetricLabels,
 		),
 	}
+	if c.MaxConcurrentRequests > 0 {
+		i.admission = semaphore.NewWeighted(int64(c.MaxConcurrentRequests))
+	}
+	if c.SitemapMaxEntries > 0 {
+		// lru.New only fails for non-positive sizes
+		i.sitemaps, _ = lru.New(sitemapCacheSize)
+	}
 	return i
 }
 
+// admit waits for one of the Config.MaxConcurrentRequests slots, for up to
+// Config.QueueTimeout, and returns whether the request got one. It must be
+// released with i.admission.Release(1).
+func (i *handler) admit(r *http.Request) bool {
+	if i.admission.TryAcquire(1) {
+		return true
+	}
+	if i.config.QueueTimeout <= 0 {
+		return false
+	}
+
+	queued := i.requestsQueuedMetric.With(i.metricLabels(r, ipath.New(r.URL.Path).Namespace()))
+	queued.Inc()
+	defer queued.Dec()
+
+	ctx, cancel := context.WithTimeout(r.Context(), i.config.QueueTimeout)
+	defer cancel()
+	return i.admission.Acquire(ctx, 1) == nil
+}
+
 func (i *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// net/http only closes the connection after an oversized body when
+	// MaxBytesReader is given its own ResponseWriter, not a wrapper
+	origW := w
+
+	i.drainLk.Lock()
+	if i.draining {
+		i.drainLk.Unlock()
+		w.Header().Set("Retry-After", retryAfter)
+		http.Error(w, "gateway is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	i.inFlight.Add(1)
+	i.drainLk.Unlock()
+	defer i.inFlight.Done()
+
 	// the hour is a hard fallback, we don't expect it to happen, but just in case
 	ctx, cancel := context.WithTimeout(r.Context(), time.Hour)
 	defer cancel()
 	r = r.WithContext(ctx)
 
+	// Drop headers the operator does not want to influence the response,
+	// before anything looks at them
+	if len(i.config.StripRequestHeaders) > 0 {
+		r.Header = r.Header.Clone()
+		for _, h := range i.config.StripRequestHeaders {
+			r.Header.Del(h)
+		}
+	}
+
+	if len(i.config.AllowedHosts) > 0 && !hostAllowed(r.Host, i.config.AllowedHosts) {
+		http.Error(w, fmt.Sprintf("host %q is not served by this gateway", r.Host), http.StatusMisdirectedRequest)
+		return
+	}
+
+	if i.admission != nil {
+		if !i.admit(r) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "gateway is over capacity", http.StatusServiceUnavailable)
+			return
+		}
+		defer i.admission.Release(1)
+	}
+
+	inFlight := i.requestsInFlightMetric.With(i.metricLabels(r, ipath.New(r.URL.Path).Namespace()))
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	pw := &panicRecoveryResponseWriter{ResponseWriter: w}
+	w = pw
 	defer func() {
-		if r := recover(); r != nil {
-			log.Error("A panic occurred in the gateway handler!")
-			log.Error(r)
-			debug.PrintStack()
+		if rec := recover(); rec != nil {
+			// Deliberate aborts of the response are left to net/http
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			log.Errorw("A panic occurred in the gateway handler!", "path", r.URL.Path, "panic", rec)
+			i.panicsMetric.With(i.metricLabels(r, ipath.New(r.URL.Path).Namespace())).Inc()
+			if i.config.Debug {
+				debug.PrintStack()
+			}
+			if !pw.wroteHeader {
+				http.Error(pw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
 		}
 	}()
 
+	if i.config.WriteTimeout > 0 {
+		w = &errRecordingResponseWriter{ResponseWriter: w, writeTimeout: i.config.WriteTimeout}
+	}
+
+	// Bound the request body: nothing reads it, but it still needs to be
+	// consumed before the connection can be reused.
+	maxBodyBytes := i.config.MaxRequestBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxRequestBodyBytes
+	}
+	if r.ContentLength > maxBodyBytes {
+		// The body is left unread, so the connection can't be reused
+		w.Header().Set("Connection", "close")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(origW, r.Body, maxBodyBytes)
+		defer r.Body.Close()
+	}
+
+	// The gateway never needs the body, so there is no point in making the
+	// client wait for the server to decide whether it wants it.
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		if i.config.RejectExpectContinue {
+			http.Error(w, http.StatusText(http.StatusExpectationFailed), http.StatusExpectationFailed)
+			return
+		}
+		w.WriteHeader(http.StatusContinue)
+	}
+
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
 		i.getOrHeadHandler(w, r)
@@ -318,6 +742,12 @@ func (i *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Drain whatever fits under the cap, MaxBytesReader closes the
+	// connection if the body turns out to be larger
+	if r.Body != nil {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}
+
 	w.Header().Add("Allow", http.MethodGet)
 	w.Header().Add("Allow", http.MethodHead)
 	w.Header().Add("Allow", http.MethodOptions)
@@ -333,47 +763,172 @@ func (i *handler) optionsHandler(w http.ResponseWriter, r *http.Request) {
 		https://developer.mozilla.org/en-US/docs/Web/HTTP/Access_control_CORS#Preflighted_requests
 	*/
 	i.addUserHeaders(w) // return all custom headers (including CORS ones, if set)
+
+	// Advertise the explicit response formats, so that clients can discover
+	// them with a cheap request
+	formats := i.enabledResponseFormats()
+	mediaTypes := make([]string, len(formats))
+	for j, f := range formats {
+		mediaTypes[j] = f.MediaType
+	}
+	w.Header().Set("X-Ipfs-Accept-Formats", strings.Join(mediaTypes, ", "))
+}
+
+// logSlowRequest warns about a request that took longer than
+// Config.SlowRequestThreshold since begin.
+func (i *handler) logSlowRequest(r *http.Request, begin time.Time) {
+	duration := i.since(begin)
+	if duration <= i.config.SlowRequestThreshold {
+		return
+	}
+	format, _ := r.Context().Value(responseFormatKey).(responseFormat)
+	fields := []interface{}{"method", r.Method, "path", r.URL.Path, "format", format.mediaType, "duration", duration, "client", ClientIP(r, i.config.TrustedProxies)}
+	log.Warnw("slow request", append(fields, connectionLogFields(r)...)...)
+}
+
+// namespaceDisabled reports whether ns is one of Config.DisabledNamespaces.
+func (i *handler) namespaceDisabled(ns string) bool {
+	for _, disabled := range i.config.DisabledNamespaces {
+		if ns == disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// mountedPath rewrites urlPath to a content path within the root CID of the
+// longest Config.Mounts prefix it falls under, and returns it unchanged when
+// there is none.
+func (i *handler) mountedPath(urlPath string) string {
+	var longest string
+	for prefix := range i.config.Mounts {
+		if len(prefix) <= len(longest) || !strings.HasPrefix(urlPath, prefix) {
+			continue
+		}
+		if len(urlPath) > len(prefix) && urlPath[len(prefix)] != '/' {
+			continue
+		}
+		longest = prefix
+	}
+	if longest == "" {
+		return urlPath
+	}
+	return "/ipfs/" + i.config.Mounts[longest].String() + urlPath[len(longest):]
+}
+
+// normalizedPath returns urlPath cleaned as described in Config.NormalizePath,
+// or unchanged when that is disabled.
+func (i *handler) normalizedPath(urlPath string) string {
+	if !i.config.NormalizePath {
+		return urlPath
+	}
+	// Keep the namespace and root out of reach of .. segments
+	parts := strings.SplitN(urlPath, "/", 4)
+	if len(parts) < 4 || parts[0] != "" {
+		return urlPath
+	}
+	rest := gopath.Clean("/" + parts[3])
+	if rest != "/" && strings.HasSuffix(parts[3], "/") {
+		rest += "/"
+	}
+	return "/" + parts[1] + "/" + parts[2] + rest
+}
+
+// handleRobotsTxt serves Config.RobotsTxt at /robots.txt, unless a mount
+// covers it.
+func (i *handler) handleRobotsTxt(w http.ResponseWriter, r *http.Request) (requestHandled bool) {
+	if r.URL.Path != "/robots.txt" || i.mountedPath(r.URL.Path) != r.URL.Path {
+		return false
+	}
+	robots := i.config.RobotsTxt
+	if robots == nil {
+		robots = []byte(DefaultRobotsTxt)
+	} else if len(robots) == 0 {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(robots)))
+	_, _ = w.Write(robots)
+	return true
 }
 
 func (i *handler) getOrHeadHandler(w http.ResponseWriter, r *http.Request) {
-	begin := time.Now()
+	sw := &spanStatusResponseWriter{ResponseWriter: w, span: trace.SpanFromContext(r.Context())}
+	w = sw
+	begin := i.now()
+	if i.config.SlowRequestThreshold > 0 {
+		defer func() { i.logSlowRequest(r, begin) }()
+	}
+	if i.config.AccessLog != nil {
+		defer func() { i.logAccess(r, sw.status, begin) }()
+	}
 
 	logger := log.With("from", r.RequestURI)
 	logger.Debug("http request received")
 
 	if err := handleUnsupportedHeaders(r); err != nil {
-		webRequestError(w, err)
+		i.webRequestError(w, err)
 		return
 	}
 
-	if requestHandled := handleProtocolHandlerRedirect(w, r, logger); requestHandled {
+	if requestHandled := i.handleProtocolHandlerRedirect(w, r, logger); requestHandled {
 		return
 	}
 
 	if err := handleServiceWorkerRegistration(r); err != nil {
-		webRequestError(w, err)
+		i.webRequestError(w, err)
 		return
 	}
 
-	contentPath := ipath.New(r.URL.Path)
+	if requestHandled := i.handleFormatsDiscovery(w, r); requestHandled {
+		return
+	}
+
+	if r.URL.Path == "/" && i.config.RootRedirect != "" {
+		http.Redirect(w, r, i.config.RootRedirect, http.StatusFound)
+		return
+	}
+
+	if requestHandled := i.handleRobotsTxt(w, r); requestHandled {
+		return
+	}
+
+	contentPath := ipath.New(i.normalizedPath(i.mountedPath(r.URL.Path)))
 	ctx := context.WithValue(r.Context(), ContentPathKey, contentPath)
 	r = r.WithContext(ctx)
 
+	if i.namespaceDisabled(contentPath.Namespace()) {
+		i.webError(w, fmt.Errorf("the /%s/ namespace is disabled on this gateway", contentPath.Namespace()), http.StatusForbidden)
+		return
+	}
+
 	if requestHandled := i.handleOnlyIfCached(w, r, contentPath, logger); requestHandled {
 		return
 	}
 
-	if requestHandled := handleSuperfluousNamespace(w, r, contentPath); requestHandled {
+	if requestHandled := i.handleSuperfluousNamespace(w, r, contentPath); requestHandled {
 		return
 	}
 
 	// Detect when explicit Accept header or ?format parameter are present
-	responseFormat, formatParams, err := customResponseFormat(r)
+	allowFormatParam := !i.config.DisableFormatQueryParam
+	responseFormats, err := customResponseFormats(r, allowFormatParam)
 	if err != nil {
-		webError(w, fmt.Errorf("error while processing the Accept header: %w", err), http.StatusBadRequest)
+		i.webError(w, fmt.Errorf("error while processing the Accept header: %w", err), http.StatusBadRequest)
 		return
 	}
-	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("ResponseFormat", responseFormat))
+	var selectedFormat responseFormat
+	responseFormat, formatParams, _ := customResponseFormat(r, allowFormatParam)
+
+	// Fail clearly before resolving a sub-path nobody asked for the content of
+	if onlyIpnsRecordRequested(responseFormats) && contentPath.Namespace() == "ipns" {
+		if err := checkIpnsRecordPath(contentPath); err != nil {
+			i.webError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
 
 	resolvedPath, contentPath, ok := i.handlePathResolution(w, r, responseFormat, contentPath, logger)
 	if !ok {
@@ -381,13 +936,44 @@ func (i *handler) getOrHeadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("ResolvedPath", resolvedPath.String()))
 
+	// Pick the first of the requested formats that can be produced for the
+	// resolved content, falling back to the next one in order of preference
+	if len(responseFormats) > 0 {
+		format, ok := selectResponseFormat(responseFormats, contentPath, resolvedPath)
+		if !ok {
+			err := fmt.Errorf("none of the requested formats can be returned for %s", debugStr(contentPath.String()))
+			webNotAcceptable(w, r, err)
+			return
+		}
+		responseFormat, formatParams = format.mediaType, format.params
+		selectedFormat = format
+	}
+	// Remember the decision, so that later lookups such as getEtag don't
+	// re-parse the request and possibly disagree with it
+	r = r.WithContext(context.WithValue(r.Context(), responseFormatKey, selectedFormat))
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("ResponseFormat", responseFormat))
+	if i.config.SpanAttributesFunc != nil {
+		trace.SpanFromContext(r.Context()).SetAttributes(i.config.SpanAttributesFunc(r)...)
+	}
+
+	// Detect when If-Match HTTP header requires returning HTTP 412 Precondition
+	// Failed, e.g. because an /ipns/ name was republished since the client
+	// last resolved it
+	if im := r.Header.Get("If-Match"); im != "" {
+		pathCid := resolvedPath.Cid()
+		if !etagIfMatch(im, i.getEtag(r, pathCid), i.getDirListingEtag(pathCid, i.listingLanguage(r))) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
 	// Detect when If-None-Match HTTP header allows returning HTTP 304 Not Modified
 	if inm := r.Header.Get("If-None-Match"); inm != "" {
 		pathCid := resolvedPath.Cid()
 		// need to check against both File and Dir Etag variants
 		// because this inexpensive check happens before we do any I/O
-		cidEtag := getEtag(r, pathCid)
-		dirEtag := getDirListingEtag(pathCid)
+		cidEtag := i.getEtag(r, pathCid)
+		dirEtag := i.getDirListingEtag(pathCid, i.listingLanguage(r))
 		if etagMatch(inm, cidEtag, dirEtag) {
 			// Finish early if client already has a matching Etag
 			w.WriteHeader(http.StatusNotModified)
@@ -395,54 +981,91 @@ func (i *handler) getOrHeadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := i.handleGettingFirstBlock(r, begin, contentPath, resolvedPath); err != nil {
-		webRequestError(w, err)
+	// Resolution-only requests are done without fetching any content
+	if responseFormat == "application/vnd.ipfs.resolve+json" {
+		logger.Debugw("serving resolved path", "path", contentPath)
+		if i.serveResolve(r.Context(), w, r, resolvedPath, contentPath, begin) {
+			i.getMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+		}
 		return
 	}
 
-	if err := i.setCommonHeaders(w, r, contentPath); err != nil {
-		webRequestError(w, err)
+	firstBlock, cacheTier, reqErr := i.handleGettingFirstBlock(r, begin, contentPath, resolvedPath)
+	if reqErr != nil {
+		i.webRequestError(w, reqErr)
 		return
 	}
 
-	var success bool
+	setDataTypeHeaders(w, firstBlock)
+	if err := i.setCommonHeaders(w, r, contentPath, cacheTier); err != nil {
+		i.webRequestError(w, err)
+		return
+	}
 
 	// Support custom response formats passed via ?format or Accept HTTP header
-	switch responseFormat {
-	case "", "application/json", "application/cbor":
-		switch mc.Code(resolvedPath.Cid().Prefix().Codec) {
-		case mc.Json, mc.DagJson, mc.Cbor, mc.DagCbor:
-			logger.Debugw("serving codec", "path", contentPath)
-			success = i.serveCodec(r.Context(), w, r, resolvedPath, contentPath, begin, responseFormat)
-		default:
-			logger.Debugw("serving unixfs", "path", contentPath)
-			success = i.serveUnixFS(r.Context(), w, r, resolvedPath, contentPath, begin, logger)
-		}
-	case "application/vnd.ipld.raw":
-		logger.Debugw("serving raw block", "path", contentPath)
+	branch := serveBranch(responseFormat, resolvedPath)
+
+	if i.config.Debug && r.URL.Query().Get("debug") == "serve-plan" {
+		i.serveServePlan(w, resolvedPath, contentPath, responseFormat, branch)
+		return
+	}
+
+	var success bool
+	if branch != "" {
+		logger.Debugw("serving "+branch, "path", contentPath)
+	}
+	switch branch {
+	case "codec":
+		success = i.serveCodec(r.Context(), w, r, resolvedPath, contentPath, begin, responseFormat)
+	case "unixfs":
+		success = i.serveUnixFS(r.Context(), w, r, resolvedPath, contentPath, begin, logger)
+	case "raw block":
 		success = i.serveRawBlock(r.Context(), w, r, resolvedPath, contentPath, begin)
-	case "application/vnd.ipld.car":
-		logger.Debugw("serving car stream", "path", contentPath)
+	case "car stream":
 		carVersion := formatParams["version"]
 		success = i.serveCAR(r.Context(), w, r, resolvedPath, contentPath, carVersion, begin)
-	case "application/x-tar":
-		logger.Debugw("serving tar file", "path", contentPath)
+	case "tar file":
 		success = i.serveTAR(r.Context(), w, r, resolvedPath, contentPath, begin, logger)
-	case "application/vnd.ipld.dag-json", "application/vnd.ipld.dag-cbor":
-		logger.Debugw("serving codec", "path", contentPath)
-		success = i.serveCodec(r.Context(), w, r, resolvedPath, contentPath, begin, responseFormat)
-	case "application/vnd.ipfs.ipns-record":
-		logger.Debugw("serving ipns record", "path", contentPath)
+	case "ipns record":
 		success = i.serveIpnsRecord(r.Context(), w, r, resolvedPath, contentPath, begin, logger)
+	case "unixfs metadata":
+		success = i.serveUnixFSMetadata(r.Context(), w, r, resolvedPath, contentPath, begin)
 	default: // catch-all for unsuported application/vnd.*
 		err := fmt.Errorf("unsupported format %q", responseFormat)
-		webError(w, err, http.StatusBadRequest)
+		webNotAcceptable(w, r, err)
 		return
 	}
 
 	if success {
-		i.getMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.getMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+	}
+}
+
+// serveBranch returns which part of the handler serves responseFormat for the
+// resolved content, or "" if the format is not supported.
+func serveBranch(responseFormat string, resolvedPath ipath.Resolved) string {
+	switch responseFormat {
+	case "", "application/json", "application/cbor":
+		switch mc.Code(resolvedPath.Cid().Prefix().Codec) {
+		case mc.Json, mc.DagJson, mc.Cbor, mc.DagCbor:
+			return "codec"
+		default:
+			return "unixfs"
+		}
+	case "application/vnd.ipld.raw":
+		return "raw block"
+	case "application/vnd.ipld.car":
+		return "car stream"
+	case "application/x-tar":
+		return "tar file"
+	case "application/vnd.ipld.dag-json", "application/vnd.ipld.dag-cbor":
+		return "codec"
+	case "application/vnd.ipfs.ipns-record", "application/vnd.ipfs.ipns-record+json":
+		return "ipns record"
+	case "application/vnd.ipfs.unixfs-metadata+json":
+		return "unixfs metadata"
 	}
+	return ""
 }
 
 func (i *handler) addUserHeaders(w http.ResponseWriter) {
@@ -451,24 +1074,52 @@ func (i *handler) addUserHeaders(w http.ResponseWriter) {
 	}
 }
 
-func addCacheControlHeaders(w http.ResponseWriter, r *http.Request, contentPath ipath.Path, fileCid cid.Cid) (modtime time.Time) {
+// now returns the current time according to the configured Clock.
+func (i *handler) now() time.Time {
+	return i.config.Clock.Now()
+}
+
+// since returns the time elapsed since t according to the configured Clock.
+func (i *handler) since(t time.Time) time.Duration {
+	return i.now().Sub(t)
+}
+
+// isImmutable reports whether responses for contentPath are cached as
+// immutable content, see Config.IsImmutableFunc.
+func (i *handler) isImmutable(contentPath ipath.Path) bool {
+	if fn := i.config.IsImmutableFunc; fn != nil {
+		return fn(contentPath)
+	}
+	return !contentPath.Mutable()
+}
+
+func (i *handler) addCacheControlHeaders(w http.ResponseWriter, r *http.Request, contentPath ipath.Path, fileCid cid.Cid) (modtime time.Time) {
 	// Set Etag to based on CID (override whatever was set before)
-	w.Header().Set("Etag", getEtag(r, fileCid))
+	w.Header().Set("Etag", i.getEtag(r, fileCid))
 
 	// Set Cache-Control and Last-Modified based on contentPath properties
-	if contentPath.Mutable() {
+	immutable := i.isImmutable(contentPath)
+	if !immutable {
 		// mutable namespaces such as /ipns/ can't be cached forever
 
 		/* For now we set Last-Modified to Now() to leverage caching heuristics built into modern browsers:
 		 * https://github.com/ipfs/kubo/pull/8074#pullrequestreview-645196768
 		 * but we should not set it to fake values and use Cache-Control based on TTL instead */
-		modtime = time.Now()
+		modtime = i.now()
+
+		if swr := i.config.StaleWhileRevalidate; swr > 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("stale-while-revalidate=%d", int(swr.Seconds())))
+		}
 
 		// TODO: set Cache-Control based on TTL of IPNS/DNSLink: https://github.com/ipfs/kubo/issues/1818#issuecomment-1015849462
 		// TODO: set Last-Modified based on /ipns/ publishing timestamp?
 	} else {
 		// immutable! CACHE ALL THE THINGS, FOREVER! wolololol
-		w.Header().Set("Cache-Control", immutableCacheControl)
+		cacheControl := i.config.ImmutableCacheControl
+		if cacheControl == "" {
+			cacheControl = immutableCacheControl
+		}
+		w.Header().Set("Cache-Control", cacheControl)
 
 		// Set modtime to 'zero time' to disable Last-Modified header (superseded by Cache-Control)
 		modtime = noModtime
@@ -476,11 +1127,17 @@ func addCacheControlHeaders(w http.ResponseWriter, r *http.Request, contentPath
 		// TODO: set Last-Modified? - TBD - /ipfs/ modification metadata is present in unixfs 1.5 https://github.com/ipfs/kubo/issues/6920?
 	}
 
+	if fn := i.config.CacheControlFunc; fn != nil {
+		if cacheControl := fn(contentPath, immutable); cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+	}
+
 	return modtime
 }
 
 // Set Content-Disposition if filename URL query param is present, return preferred filename
-func addContentDispositionHeader(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) string {
+func (i *handler) addContentDispositionHeader(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) string {
 	/* This logic enables:
 	 * - creation of HTML links that trigger "Save As.." dialog instead of being rendered by the browser
 	 * - overriding the filename used when saving subresource assets on HTML page
@@ -490,7 +1147,7 @@ func addContentDispositionHeader(w http.ResponseWriter, r *http.Request, content
 	// URL param ?filename=cat.jpg triggers Content-Disposition: [..] filename
 	// which impacts default name used in "Save As.." dialog
 	name := getFilename(contentPath)
-	urlFilename := r.URL.Query().Get("filename")
+	urlFilename := i.urlFilename(r)
 	if urlFilename != "" {
 		disposition := "inline"
 		// URL param ?download=true triggers Content-Disposition: [..] attachment
@@ -504,15 +1161,56 @@ func addContentDispositionHeader(w http.ResponseWriter, r *http.Request, content
 	return name
 }
 
-// Set Content-Disposition to arbitrary filename and disposition
+// urlFilename returns the ?filename requested by the client, passed through
+// Config.FilenameValidator if set. An empty string is returned when there is
+// no filename or it was rejected, so that the default name is used.
+func (i *handler) urlFilename(r *http.Request) string {
+	filename := r.URL.Query().Get("filename")
+	if filename == "" || i.config.FilenameValidator == nil {
+		return filename
+	}
+	filename, err := i.config.FilenameValidator(filename)
+	if err != nil {
+		log.Debugw("rejected filename", "path", r.URL.Path, "error", err)
+		return ""
+	}
+	return filename
+}
+
+// Set Content-Disposition to arbitrary filename and disposition.
+// The filename parameter carries an ASCII-only version of the name, and
+// filename* (RFC 5987) the full UTF-8 one when the name is not plain ASCII.
 func setContentDispositionHeader(w http.ResponseWriter, filename string, disposition string) {
-	utf8Name := url.PathEscape(filename)
-	asciiName := url.PathEscape(onlyASCII.ReplaceAllLiteralString(filename, "_"))
-	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, asciiName, utf8Name))
+	asciiName := onlyASCII.ReplaceAllLiteralString(filename, "_")
+	asciiName = asciiControl.ReplaceAllLiteralString(asciiName, "_")
+	value := fmt.Sprintf("%s; filename=\"%s\"", disposition, quotedStringEscaper.Replace(asciiName))
+	if asciiName != filename {
+		value += "; filename*=UTF-8''" + rfc5987Escape(filename)
+	}
+	w.Header().Set("Content-Disposition", value)
+}
+
+// quotedStringEscaper escapes characters that can't appear as-is in an HTTP
+// quoted-string.
+var quotedStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// rfc5987Escape percent-encodes s for use as an RFC 5987 ext-value. Only
+// attr-char are left as-is, except '+', which some clients decode as a space.
+func rfc5987Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
 }
 
 // Set X-Ipfs-Roots with logical CID array for efficient HTTP cache invalidation.
-func (i *handler) buildIpfsRootsHeader(contentPath string, r *http.Request) (string, error) {
+func (i *handler) buildIpfsRootsHeader(contentPath string, r *http.Request) (rootCidList string, truncated bool, err error) {
 	/*
 		These are logical roots where each CID represent one path segment
 		and resolves to either a directory or the root block of a file.
@@ -535,8 +1233,49 @@ func (i *handler) buildIpfsRootsHeader(contentPath string, r *http.Request) (str
 		Note that while the top one will change every time any article is changed,
 		the last root (responsible for specific article) may not change at all.
 	*/
+	pathRoots, err := i.resolvePathRoots(r.Context(), contentPath)
+	if err != nil {
+		return "", false, err
+	}
+	rootCids := make([]string, len(pathRoots))
+	for i, root := range pathRoots {
+		rootCids[i] = root.String()
+	}
+	rootCidList = strings.Join(rootCids, ",") // convention from rfc2616#sec4.2
+
+	// Past the limit, keep the most specific roots: those closest to the
+	// requested entity change least often, and are the most useful for
+	// invalidation. The last root is always kept.
+	if limit := i.config.MaxIpfsRootsHeaderBytes; limit > 0 {
+		for len(rootCidList) > limit && len(rootCids) > 1 {
+			rootCidList = rootCidList[len(rootCids[0])+1:]
+			rootCids = rootCids[1:]
+			truncated = true
+		}
+	}
+	return rootCidList, truncated, nil
+}
+
+// ResolveLogicalRoots resolves every segment of contentPath with api,
+// returning the CID each sub path resolves to, from the content root down to
+// the requested entity. These are the logical roots the gateway sends in the
+// X-Ipfs-Roots header, e.g. for purging HTTP caches when some of them change.
+func ResolveLogicalRoots(ctx context.Context, api API, contentPath string) ([]cid.Cid, error) {
+	if err := ipath.New(contentPath).IsValid(); err != nil {
+		return nil, err
+	}
+	return resolveLogicalRoots(ctx, contentPath, api.ResolvePath)
+}
+
+// resolvePathRoots is ResolveLogicalRoots using the resolver cache and
+// timeouts configured on the handler.
+func (i *handler) resolvePathRoots(ctx context.Context, contentPath string) ([]cid.Cid, error) {
+	return resolveLogicalRoots(ctx, contentPath, i.resolvePath)
+}
+
+func resolveLogicalRoots(ctx context.Context, contentPath string, resolve func(context.Context, ipath.Path) (ipath.Resolved, error)) ([]cid.Cid, error) {
 	var sp strings.Builder
-	var pathRoots []string
+	var pathRoots []cid.Cid
 	pathSegments := strings.Split(contentPath[6:], "/")
 	sp.WriteString(contentPath[:5]) // /ipfs or /ipns
 	for _, root := range pathSegments {
@@ -545,32 +1284,31 @@ func (i *handler) buildIpfsRootsHeader(contentPath string, r *http.Request) (str
 		}
 		sp.WriteString("/")
 		sp.WriteString(root)
-		resolvedSubPath, err := i.api.ResolvePath(r.Context(), ipath.New(sp.String()))
+		resolvedSubPath, err := resolve(ctx, ipath.New(sp.String()))
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		pathRoots = append(pathRoots, resolvedSubPath.Cid().String())
+		pathRoots = append(pathRoots, resolvedSubPath.Cid())
 	}
-	rootCidList := strings.Join(pathRoots, ",") // convention from rfc2616#sec4.2
-	return rootCidList, nil
+	return pathRoots, nil
 }
 
-func webRequestError(w http.ResponseWriter, err *requestError) {
-	webError(w, err.Err, err.StatusCode)
+func (i *handler) webRequestError(w http.ResponseWriter, err *requestError) {
+	i.webError(w, err.Err, err.StatusCode)
 }
 
-func webError(w http.ResponseWriter, err error, defaultCode int) {
+func (i *handler) webError(w http.ResponseWriter, err error, defaultCode int) {
 	switch {
 	case isErrNotFound(err):
-		webErrorWithCode(w, err, http.StatusNotFound)
+		i.webErrorWithCode(w, err, http.StatusNotFound)
 	case errors.Is(err, ErrGatewayTimeout):
-		webErrorWithCode(w, err, http.StatusGatewayTimeout)
+		i.webErrorWithCode(w, err, http.StatusGatewayTimeout)
 	case errors.Is(err, ErrBadGateway):
-		webErrorWithCode(w, err, http.StatusBadGateway)
+		i.webErrorWithCode(w, err, http.StatusBadGateway)
 	case errors.Is(err, context.DeadlineExceeded):
-		webErrorWithCode(w, err, http.StatusGatewayTimeout)
+		i.webErrorWithCode(w, err, http.StatusGatewayTimeout)
 	default:
-		webErrorWithCode(w, err, defaultCode)
+		i.webErrorWithCode(w, err, defaultCode)
 	}
 }
 
@@ -595,8 +1333,14 @@ func isErrNotFound(err error) bool {
 	}
 }
 
-func webErrorWithCode(w http.ResponseWriter, err error, code int) {
-	http.Error(w, err.Error(), code)
+func (i *handler) webErrorWithCode(w http.ResponseWriter, err error, code int) {
+	recordSpanError(w, err)
+	msg := err.Error()
+	if code >= 500 && i.config.GenericServerErrors {
+		// the details stay in the log below
+		msg = http.StatusText(code)
+	}
+	http.Error(w, msg, code)
 	if code >= 500 {
 		log.Warnf("server error: %s", err)
 	}
@@ -676,11 +1420,45 @@ func etagWeakMatch(a, b string) bool {
 	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
 }
 
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagIfMatch evaluates if the If-Match precondition holds, using strong
+// comparison against both the File and Dir Etag variants.
+func etagIfMatch(ifMatchHeader string, cidEtag string, dirEtag string) bool {
+	buf := ifMatchHeader
+	for {
+		buf = textproto.TrimString(buf)
+		if len(buf) == 0 {
+			break
+		}
+		if buf[0] == ',' {
+			buf = buf[1:]
+			continue
+		}
+		// If-Match: * matches any existing representation
+		if buf[0] == '*' {
+			return true
+		}
+		etag, remain := scanETag(buf)
+		if etag == "" {
+			break
+		}
+		if etagStrongMatch(etag, cidEtag) || etagStrongMatch(etag, dirEtag) {
+			return true
+		}
+		buf = remain
+	}
+	return false
+}
+
 // generate Etag value based on HTTP request and CID
-func getEtag(r *http.Request, cid cid.Cid) string {
+func (i *handler) getEtag(r *http.Request, cid cid.Cid) string {
 	prefix := `"`
 	suffix := `"`
-	responseFormat, _, err := customResponseFormat(r)
+	responseFormat, _, err := customResponseFormat(r, !i.config.DisableFormatQueryParam)
 	if err == nil && responseFormat != "" {
 		// application/vnd.ipld.foo → foo
 		// application/x-bar → x-bar
@@ -692,37 +1470,54 @@ func getEtag(r *http.Request, cid cid.Cid) string {
 	return prefix + cid.String() + suffix
 }
 
-// return explicit response format if specified in request as query parameter or via Accept HTTP header
-func customResponseFormat(r *http.Request) (mediaType string, params map[string]string, err error) {
-	if formatParam := r.URL.Query().Get("format"); formatParam != "" {
-		// translate query param to a content type
-		switch formatParam {
-		case "raw":
-			return "application/vnd.ipld.raw", nil, nil
-		case "car":
-			return "application/vnd.ipld.car", nil, nil
-		case "tar":
-			return "application/x-tar", nil, nil
-		case "json":
-			return "application/json", nil, nil
-		case "cbor":
-			return "application/cbor", nil, nil
-		case "dag-json":
-			return "application/vnd.ipld.dag-json", nil, nil
-		case "dag-cbor":
-			return "application/vnd.ipld.dag-cbor", nil, nil
-		case "ipns-record":
-			return "application/vnd.ipfs.ipns-record", nil, nil
+// responseFormat is an explicit response format requested by the client.
+type responseFormat struct {
+	mediaType string
+	params    map[string]string
+}
+
+// responseFormatKey holds the responseFormat selected for the resolved
+// content, once getOrHeadHandler made that decision.
+const responseFormatKey RequestContextKey = "response-format"
+
+// return explicit response format if specified in request as query parameter or via Accept HTTP header.
+// The ?format query parameter is ignored unless allowFormatParam is true.
+func customResponseFormat(r *http.Request, allowFormatParam bool) (mediaType string, params map[string]string, err error) {
+	if format, ok := r.Context().Value(responseFormatKey).(responseFormat); ok {
+		return format.mediaType, format.params, nil
+	}
+
+	formats, err := customResponseFormats(r, allowFormatParam)
+	if err != nil || len(formats) == 0 {
+		// If none of special-cased content types is found, return empty string
+		// to indicate default, implicit UnixFS response should be prepared
+		return "", nil, err
+	}
+
+	// Prefer the first format we know how to produce
+	for _, format := range formats {
+		if isKnownResponseFormat(format.mediaType) {
+			return format.mediaType, format.params, nil
 		}
 	}
+	return formats[0].mediaType, formats[0].params, nil
+}
+
+// customResponseFormats returns all explicit response formats specified in
+// request as query parameter or via Accept HTTP header, in order of preference.
+func customResponseFormats(r *http.Request, allowFormatParam bool) ([]responseFormat, error) {
+	if format, ok := queryResponseFormat(r, allowFormatParam); ok {
+		return []responseFormat{format}, nil
+	}
 	// Browsers and other user agents will send Accept header with generic types like:
 	// Accept:text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8
-	// We only care about explicit, vendor-specific content-types and respond to the first match (in order).
+	// We only care about explicit, vendor-specific content-types and keep them in order,
+	// so that we can fall back to the next one if the first can't be returned.
 	// TODO: make this RFC compliant and respect weights (eg. return CAR for Accept:application/vnd.ipld.dag-json;q=0.1,application/vnd.ipld.car;q=0.2)
+	var formats []responseFormat
 	for _, header := range r.Header.Values("Accept") {
 		for _, value := range strings.Split(header, ",") {
 			accept := strings.TrimSpace(value)
-			// respond to the very first matching content type
 			if strings.HasPrefix(accept, "application/vnd.ipld") ||
 				strings.HasPrefix(accept, "application/x-tar") ||
 				strings.HasPrefix(accept, "application/json") ||
@@ -730,15 +1525,178 @@ func customResponseFormat(r *http.Request) (mediaType string, params map[string]
 				strings.HasPrefix(accept, "application/vnd.ipfs") {
 				mediatype, params, err := mime.ParseMediaType(accept)
 				if err != nil {
-					return "", nil, err
+					return nil, err
 				}
-				return mediatype, params, nil
+				formats = append(formats, responseFormat{mediaType: mediatype, params: params})
+			}
+		}
+	}
+	return formats, nil
+}
+
+// queryResponseFormat returns the response format requested with the
+// ?format query parameter, which takes precedence over the Accept header.
+func queryResponseFormat(r *http.Request, allowFormatParam bool) (responseFormat, bool) {
+	if formatParam := r.URL.Query().Get("format"); allowFormatParam && formatParam != "" {
+		// translate query param to a content type
+		for _, f := range knownResponseFormats {
+			if f.Format == formatParam {
+				return responseFormat{mediaType: f.MediaType}, true
+			}
+		}
+	}
+	return responseFormat{}, false
+}
+
+// knownResponseFormat is an explicit response format the gateway can produce,
+// with the media type used in the Accept header and the matching value of the
+// ?format query parameter.
+type knownResponseFormat struct {
+	MediaType string `json:"mediaType"`
+	Format    string `json:"format,omitempty"`
+}
+
+var knownResponseFormats = []knownResponseFormat{
+	{"application/vnd.ipld.raw", "raw"},
+	{"application/vnd.ipld.car", "car"},
+	{"application/x-tar", "tar"},
+	{"application/json", "json"},
+	{"application/cbor", "cbor"},
+	{"application/vnd.ipld.dag-json", "dag-json"},
+	{"application/vnd.ipld.dag-cbor", "dag-cbor"},
+	{"application/vnd.ipfs.ipns-record", "ipns-record"},
+	{"application/vnd.ipfs.ipns-record+json", "ipns-record-json"},
+	{"application/vnd.ipfs.unixfs-metadata+json", "unixfs-metadata"},
+	{"application/vnd.ipfs.resolve+json", "resolve"},
+}
+
+// isKnownResponseFormat returns true if the gateway has a handler for the
+// explicit response format.
+func isKnownResponseFormat(mediaType string) bool {
+	for _, f := range knownResponseFormats {
+		if f.MediaType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// webNotAcceptable replies with 406 Not Acceptable, listing the media types
+// the gateway supports. The reply is JSON if the client accepts it.
+func webNotAcceptable(w http.ResponseWriter, r *http.Request, err error) {
+	supported := make([]string, len(knownResponseFormats))
+	for i, f := range knownResponseFormats {
+		supported[i] = f.MediaType
+	}
+
+	if !acceptsJSON(r) {
+		msg := fmt.Sprintf("%s\nsupported formats: %s", err, strings.Join(supported, ", "))
+		http.Error(w, msg, http.StatusNotAcceptable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotAcceptable)
+	if err := json.NewEncoder(w).Encode(struct {
+		Message   string   `json:"message"`
+		Supported []string `json:"supported"`
+	}{err.Error(), supported}); err != nil {
+		log.Debugw("error writing not acceptable response", "error", err)
+	}
+}
+
+// acceptsJSON returns true if the Accept header lists a JSON media type,
+// such as application/json or application/problem+json.
+func acceptsJSON(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, value := range strings.Split(header, ",") {
+			mediatype, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+			if err != nil {
+				continue
+			}
+			if mediatype == "application/json" || strings.HasSuffix(mediatype, "+json") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleFormatsDiscovery lists the explicit response formats supported by
+// the gateway as JSON when requested with GET /ipfs?formats, so that clients
+// can adapt their requests instead of probing.
+func (i *handler) handleFormatsDiscovery(w http.ResponseWriter, r *http.Request) (requestHandled bool) {
+	if strings.TrimSuffix(r.URL.Path, "/") != "/ipfs" {
+		return false
+	}
+	if _, ok := r.URL.Query()["formats"]; !ok {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(struct {
+		Formats []knownResponseFormat `json:"formats"`
+	}{i.enabledResponseFormats()}); err != nil {
+		log.Debugw("error writing formats list", "error", err)
+	}
+	return true
+}
+
+// enabledResponseFormats returns the explicit response formats clients can
+// request from this handler, as configured. Format is left empty when the
+// ?format query parameter is disabled.
+func (i *handler) enabledResponseFormats() []knownResponseFormat {
+	formats := make([]knownResponseFormat, len(knownResponseFormats))
+	copy(formats, knownResponseFormats)
+	if i.config.DisableFormatQueryParam {
+		for j := range formats {
+			formats[j].Format = ""
+		}
+	}
+	return formats
+}
+
+// selectResponseFormat returns the first of the requested formats that can
+// be returned for the resolved content.
+func selectResponseFormat(formats []responseFormat, contentPath ipath.Path, resolvedPath ipath.Resolved) (responseFormat, bool) {
+	for _, format := range formats {
+		if !isKnownResponseFormat(format.mediaType) {
+			continue
+		}
+		switch format.mediaType {
+		case "application/x-tar", "application/vnd.ipfs.unixfs-metadata+json":
+			// TAR and UnixFS metadata can only be generated from UnixFS
+			codec := mc.Code(resolvedPath.Cid().Prefix().Codec)
+			if codec != mc.DagPb && codec != mc.Raw {
+				continue
 			}
+		case "application/vnd.ipfs.ipns-record", "application/vnd.ipfs.ipns-record+json":
+			// Records only exist for the root of IPNS names
+			if contentPath.Namespace() != "ipns" || checkIpnsRecordPath(contentPath) != nil {
+				continue
+			}
+		}
+		return format, true
+	}
+	return responseFormat{}, false
+}
+
+// onlyIpnsRecordRequested returns true when an IPNS record is the only known
+// format among the requested ones, so there is nothing to fall back to.
+func onlyIpnsRecordRequested(formats []responseFormat) bool {
+	found := false
+	for _, format := range formats {
+		if !isKnownResponseFormat(format.mediaType) {
+			continue
 		}
+		if format.mediaType != "application/vnd.ipfs.ipns-record" && format.mediaType != "application/vnd.ipfs.ipns-record+json" {
+			return false
+		}
+		found = true
 	}
-	// If none of special-cased content types is found, return empty string
-	// to indicate default, implicit UnixFS response should be prepared
-	return "", nil, nil
+	return found
 }
 
 // returns unquoted path with all special characters revealed as \u codes
@@ -750,22 +1708,135 @@ func debugStr(path string) string {
 	return q
 }
 
+// resolvePath resolves the path through the configured ResolverCache, if any,
+// falling back to the API. Resolution of /ipns/ paths is bounded by
+// Config.IPNSResolveTimeout.
+func (i *handler) resolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	cache := i.config.ResolverCache
+	if staleCache, ok := cache.(StaleResolverCache); ok && i.config.StaleWhileRevalidate > 0 {
+		if resolved, stale, ok := staleCache.GetStale(p, i.config.StaleWhileRevalidate); ok {
+			if stale {
+				i.revalidate(p)
+			}
+			return resolved, nil
+		}
+	} else if cache != nil {
+		if resolved, ok := cache.Get(p); ok {
+			return resolved, nil
+		}
+	}
+
+	resolveCtx := ctx
+	if timeout := i.config.IPNSResolveTimeout; timeout > 0 && p.Namespace() == "ipns" {
+		var cancel context.CancelFunc
+		resolveCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resolved, err := i.resolveDNSLinkAndPath(resolveCtx, p)
+	if err != nil {
+		if resolveCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return nil, fmt.Errorf("resolving %s took longer than %s: %w", debugStr(p.String()), i.config.IPNSResolveTimeout, ErrGatewayTimeout)
+		}
+		return nil, err
+	}
+
+	if cache != nil {
+		cache.Add(p, resolved)
+	}
+	return resolved, nil
+}
+
+// revalidateTimeout bounds background resolutions of stale paths when
+// Config.IPNSResolveTimeout is not set.
+const revalidateTimeout = time.Minute
+
+// revalidate resolves p again in the background and updates the
+// ResolverCache with the result, unless that is already happening.
+func (i *handler) revalidate(p ipath.Path) {
+	key := p.String()
+	i.revalidateLk.Lock()
+	if _, ok := i.revalidating[key]; ok {
+		i.revalidateLk.Unlock()
+		return
+	}
+	i.revalidating[key] = struct{}{}
+	i.revalidateLk.Unlock()
+
+	go func() {
+		defer func() {
+			i.revalidateLk.Lock()
+			delete(i.revalidating, key)
+			i.revalidateLk.Unlock()
+		}()
+
+		timeout := i.config.IPNSResolveTimeout
+		if timeout <= 0 {
+			timeout = revalidateTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		resolved, err := i.resolveDNSLinkAndPath(ctx, p)
+		if err != nil {
+			log.Debugw("revalidating stale path failed", "path", p, "error", err)
+			return
+		}
+		i.config.ResolverCache.Add(p, resolved)
+	}()
+}
+
+// resolveDNSLinkAndPath resolves the path through the API, after looking up
+// the DNSLink name of /ipns/<domain> paths with Config.DNSLinkResolver, if
+// set.
+func (i *handler) resolveDNSLinkAndPath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	if i.config.DNSLinkResolver != nil && p.Namespace() == "ipns" {
+		name, rest, _ := strings.Cut(strings.TrimPrefix(p.String(), ipnsPathPrefix), "/")
+		if isDomainNameAndNotPeerID(name) {
+			value, err := i.config.DNSLinkResolver(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			if rest != "" || strings.HasSuffix(p.String(), "/") {
+				rest = "/" + rest
+			}
+			p = ipath.New(strings.TrimSuffix(value.String(), "/") + rest)
+		}
+	}
+	return i.api.ResolvePath(ctx, p)
+}
+
 // Resolve the provided contentPath including any special handling related to
 // the requested responseFormat. Returned ok flag indicates if gateway handler
 // should continue processing the request.
 func (i *handler) handlePathResolution(w http.ResponseWriter, r *http.Request, responseFormat string, contentPath ipath.Path, logger *zap.SugaredLogger) (resolvedPath ipath.Resolved, newContentPath ipath.Path, ok bool) {
 	// Attempt to resolve the provided path.
-	resolvedPath, err := i.api.ResolvePath(r.Context(), contentPath)
+	resolvedPath, err := i.resolvePath(r.Context(), contentPath)
+	if delay := i.config.RetryIPNSOnce; delay > 0 && contentPath.Namespace() == "ipns" && isErrNameNotResolved(err) {
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+		case <-timer.C:
+			logger.Debugw("retrying ipns resolution", "path", contentPath)
+			resolvedPath, err = i.resolvePath(r.Context(), contentPath)
+		}
+	}
 
-	switch err {
-	case nil:
+	switch {
+	case err == nil:
 		return resolvedPath, contentPath, true
-	case coreiface.ErrOffline:
+	case errors.Is(err, ErrGatewayTimeout):
+		i.webError(w, err, http.StatusGatewayTimeout)
+		return nil, nil, false
+	case err == coreiface.ErrOffline:
 		err = fmt.Errorf("failed to resolve %s: %w", debugStr(contentPath.String()), err)
-		webError(w, err, http.StatusServiceUnavailable)
+		i.webError(w, err, http.StatusServiceUnavailable)
 		return nil, nil, false
 	default:
 		// The path can't be resolved.
+		if isUnixfsResponseFormat(responseFormat) && isErrNotFound(err) && i.serveSitemapIfRequested(w, r, contentPath) {
+			logger.Debugw("served generated sitemap")
+			return nil, nil, false
+		}
 		if isUnixfsResponseFormat(responseFormat) {
 			// If we have origin isolation (subdomain gw, DNSLink website),
 			// and response type is UnixFS (default for website hosting)
@@ -788,17 +1859,82 @@ func (i *handler) handlePathResolution(w http.ResponseWriter, r *http.Request, r
 			}
 		}
 
+		code := http.StatusInternalServerError
+		if i.config.MissingDNSLinkNotFound && isErrDNSLinkNotFound(contentPath, err) {
+			code = http.StatusNotFound
+		}
+		if ancestor, ancestorCid, ok := i.noLinkAncestor(r.Context(), contentPath, err); ok {
+			w.Header().Set("X-Ipfs-Resolved-Ancestor", ancestor.String())
+			err = fmt.Errorf("%w (deepest resolved ancestor: %s, %s)", err, debugStr(ancestor.String()), ancestorCid)
+		}
 		err = fmt.Errorf("failed to resolve %s: %w", debugStr(contentPath.String()), err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, code)
 		return nil, nil, false
 	}
 }
 
+// noLinkAncestor returns the deepest ancestor of contentPath that resolved
+// before err, a resolver.ErrNoLink, stopped the resolution, and its CID.
+func (i *handler) noLinkAncestor(ctx context.Context, contentPath ipath.Path, err error) (ipath.Path, cid.Cid, bool) {
+	var noLink resolver.ErrNoLink
+	if !errors.As(err, &noLink) {
+		return nil, cid.Undef, false
+	}
+
+	// the error only names the missing link and the node it was looked up
+	// in, so find the segment it stands for, which may not be the only one
+	// with that name
+	segments := strings.Split(strings.TrimPrefix(contentPath.String(), "/"), "/")
+	for k := 2; k < len(segments); k++ {
+		if segments[k] != noLink.Name {
+			continue
+		}
+		ancestor := ipath.New("/" + strings.Join(segments[:k], "/"))
+		resolved, err := i.resolvePath(ctx, ancestor)
+		if err == nil && resolved.Cid() == noLink.Node {
+			return ancestor, resolved.Cid(), true
+		}
+	}
+	return nil, cid.Undef, false
+}
+
+// isErrDNSLinkNotFound returns true when err means that the DNSLink name of
+// contentPath does not exist or has no DNSLink record, as opposed to failing
+// to be looked up.
+func isErrDNSLinkNotFound(contentPath ipath.Path, err error) bool {
+	if contentPath.Namespace() != "ipns" {
+		return false
+	}
+	name, _, _ := strings.Cut(strings.TrimPrefix(contentPath.String(), ipnsPathPrefix), "/")
+	if !isDomainNameAndNotPeerID(name) {
+		return false
+	}
+	return isErrNameNotResolved(err)
+}
+
+// isErrNameNotResolved returns true when err means that an /ipns/ name
+// could not be resolved, as opposed to content missing under it.
+func isErrNameNotResolved(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsNotFound
+	}
+	return errors.Is(err, namesys.ErrResolveFailed)
+}
+
 // Detect 'Cache-Control: only-if-cached' in request and return data if it is already in the local datastore.
 // https://github.com/ipfs/specs/blob/main/http-gateways/PATH_GATEWAY.md#cache-control-request-header
 func (i *handler) handleOnlyIfCached(w http.ResponseWriter, r *http.Request, contentPath ipath.Path, logger *zap.SugaredLogger) (requestHandled bool) {
 	if r.Header.Get("Cache-Control") == "only-if-cached" {
-		if !i.api.IsCached(r.Context(), contentPath) {
+		cached := i.api.IsCached(r.Context(), contentPath)
+		labels := i.metricLabels(r, contentPath.Namespace())
+		if cached {
+			labels["result"] = "hit"
+		} else {
+			labels["result"] = "miss"
+		}
+		i.onlyIfCachedMetric.With(labels).Inc()
+		if !cached {
 			if r.Method == http.MethodHead {
 				w.WriteHeader(http.StatusPreconditionFailed)
 				return true
@@ -825,19 +1961,28 @@ func handleUnsupportedHeaders(r *http.Request) (err *requestError) {
 	return nil
 }
 
+// permanentRedirectCode returns the status code of permanent redirects, see
+// Config.MethodPreservingRedirects.
+func (i *handler) permanentRedirectCode() int {
+	if i.config.MethodPreservingRedirects {
+		return http.StatusPermanentRedirect
+	}
+	return http.StatusMovedPermanently
+}
+
 // ?uri query param support for requests produced by web browsers
 // via navigator.registerProtocolHandler Web API
 // https://developer.mozilla.org/en-US/docs/Web/API/Navigator/registerProtocolHandler
 // TLDR: redirect /ipfs/?uri=ipfs%3A%2F%2Fcid%3Fquery%3Dval to /ipfs/cid?query=val
-func handleProtocolHandlerRedirect(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger) (requestHandled bool) {
+func (i *handler) handleProtocolHandlerRedirect(w http.ResponseWriter, r *http.Request, logger *zap.SugaredLogger) (requestHandled bool) {
 	if uriParam := r.URL.Query().Get("uri"); uriParam != "" {
 		u, err := url.Parse(uriParam)
 		if err != nil {
-			webError(w, fmt.Errorf("failed to parse uri query parameter: %w", err), http.StatusBadRequest)
+			i.webError(w, fmt.Errorf("failed to parse uri query parameter: %w", err), http.StatusBadRequest)
 			return true
 		}
 		if u.Scheme != "ipfs" && u.Scheme != "ipns" {
-			webError(w, fmt.Errorf("uri query parameter scheme must be ipfs or ipns: %w", err), http.StatusBadRequest)
+			i.webError(w, fmt.Errorf("uri query parameter scheme must be ipfs or ipns: %w", err), http.StatusBadRequest)
 			return true
 		}
 		path := u.Path
@@ -845,9 +1990,9 @@ func handleProtocolHandlerRedirect(w http.ResponseWriter, r *http.Request, logge
 			path = path + "?" + u.RawQuery
 		}
 
-		redirectURL := gopath.Join("/", u.Scheme, u.Host, path)
-		logger.Debugw("uri param, redirect", "to", redirectURL, "status", http.StatusMovedPermanently)
-		http.Redirect(w, r, redirectURL, http.StatusMovedPermanently)
+		redirectURL := i.externalURL(r, gopath.Join("/", u.Scheme, u.Host, path))
+		logger.Debugw("uri param, redirect", "to", redirectURL, "status", i.permanentRedirectCode())
+		http.Redirect(w, r, redirectURL, i.permanentRedirectCode())
 		return true
 	}
 
@@ -872,7 +2017,7 @@ func handleServiceWorkerRegistration(r *http.Request) (err *requestError) {
 // 'intended' path is valid.  This is in case gremlins were tickled
 // wrong way and user ended up at /ipfs/ipfs/{cid} or /ipfs/ipns/{id}
 // like in bafybeien3m7mdn6imm425vc2s22erzyhbvk5n3ofzgikkhmdkh5cuqbpbq :^))
-func handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) (requestHandled bool) {
+func (i *handler) handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) (requestHandled bool) {
 	// If the path is valid, there's nothing to do
 	if pathErr := contentPath.IsValid(); pathErr == nil {
 		return false
@@ -886,7 +2031,7 @@ func handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentP
 	// Attempt to fix the superflous namespace
 	intendedPath := ipath.New(strings.TrimPrefix(r.URL.Path, "/ipfs"))
 	if err := intendedPath.IsValid(); err != nil {
-		webError(w, fmt.Errorf("invalid ipfs path: %w", err), http.StatusBadRequest)
+		i.webError(w, fmt.Errorf("invalid ipfs path: %w", err), http.StatusBadRequest)
 		return true
 	}
 	intendedURL := intendedPath.String()
@@ -895,6 +2040,7 @@ func handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentP
 		q, _ := url.ParseQuery(r.URL.RawQuery)
 		intendedURL = intendedURL + "?" + q.Encode()
 	}
+	intendedURL = i.externalURL(r, intendedURL)
 	// return HTTP 400 (Bad Request) with HTML error page that:
 	// - points at correct canonical path via <link> header
 	// - displays human-readable error
@@ -906,41 +2052,201 @@ func handleSuperfluousNamespace(w http.ResponseWriter, r *http.Request, contentP
 		SuggestedPath: intendedPath.String(),
 		ErrorMsg:      fmt.Sprintf("invalid path: %q should be %q", r.URL.Path, intendedPath.String()),
 	}); err != nil {
-		webError(w, fmt.Errorf("failed to redirect when fixing superfluous namespace: %w", err), http.StatusBadRequest)
+		i.webError(w, fmt.Errorf("failed to redirect when fixing superfluous namespace: %w", err), http.StatusBadRequest)
 	}
 
 	return true
 }
 
-func (i *handler) handleGettingFirstBlock(r *http.Request, begin time.Time, contentPath ipath.Path, resolvedPath ipath.Resolved) *requestError {
+// externalURL turns the path into an absolute URL pointing at the host and
+// scheme the client used, as reported by a trusted reverse proxy via
+// X-Forwarded-Host and X-Forwarded-Proto. Without Config.TrustXForwardedHeaders,
+// or when the request did not go through a proxy, the path is returned as-is.
+func (i *handler) externalURL(r *http.Request, path string) string {
+	if !i.config.TrustXForwardedHeaders {
+		return path
+	}
+
+	// Use the value set by the proxy closest to the client
+	host := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0])
+	if host == "" {
+		return path
+	}
+
+	scheme := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])
+	if scheme == "" {
+		if r.TLS != nil {
+			scheme = "https"
+		} else {
+			scheme = "http"
+		}
+	}
+
+	return scheme + "://" + host + path
+}
+
+// The cache tier the block came from is returned when the API is a
+// CacheTierAPI.
+func (i *handler) handleGettingFirstBlock(r *http.Request, begin time.Time, contentPath ipath.Path, resolvedPath ipath.Resolved) (blocks.Block, CacheTier, *requestError) {
 	// Update the global metric of the time it takes to read the final root block of the requested resource
 	// NOTE: for legacy reasons this happens before we go into content-type specific code paths
-	_, err := i.api.GetBlock(r.Context(), resolvedPath.Cid())
+	ctx := r.Context()
+	if timeout := i.config.FirstBlockTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var (
+		blk  blocks.Block
+		tier CacheTier
+		err  error
+	)
+	if tierAPI, ok := i.api.(CacheTierAPI); ok {
+		blk, tier, err = tierAPI.GetBlockCacheTier(ctx, resolvedPath.Cid())
+	} else {
+		blk, err = i.api.GetBlock(ctx, resolvedPath.Cid())
+	}
 	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
+			err = fmt.Errorf("getting block %s took longer than %s: %w", resolvedPath.Cid().String(), i.config.FirstBlockTimeout, ErrGatewayTimeout)
+			return nil, "", newRequestError(err, http.StatusGatewayTimeout)
+		}
 		err = fmt.Errorf("could not get block %s: %w", resolvedPath.Cid().String(), err)
-		return newRequestError(err, http.StatusInternalServerError)
+		return nil, "", newRequestError(err, http.StatusInternalServerError)
 	}
 	ns := contentPath.Namespace()
-	timeToGetFirstContentBlock := time.Since(begin).Seconds()
-	i.unixfsGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock) // deprecated, use firstContentBlockGetMetric instead
-	i.firstContentBlockGetMetric.WithLabelValues(ns).Observe(timeToGetFirstContentBlock)
-	return nil
+	timeToGetFirstContentBlock := i.since(begin).Seconds()
+	i.unixfsGetMetric.With(i.metricLabels(r, ns)).Observe(timeToGetFirstContentBlock) // deprecated, use firstContentBlockGetMetric instead
+	i.firstContentBlockGetMetric.With(i.metricLabels(r, ns)).Observe(timeToGetFirstContentBlock)
+	return blk, tier, nil
 }
 
-func (i *handler) setCommonHeaders(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) *requestError {
+// setDataTypeHeaders sets X-Ipfs-DataType and, for files, X-Ipfs-FileSize
+// based on the root block of the resolved content. Nothing is set for blocks
+// that are not UnixFS.
+func setDataTypeHeaders(w http.ResponseWriter, blk blocks.Block) {
+	dataType, size, ok := unixfsDataType(blk)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("X-Ipfs-DataType", dataType)
+	if dataType == "file" {
+		w.Header().Set("X-Ipfs-FileSize", strconv.FormatUint(size, 10))
+	}
+}
+
+// unixfsDataType returns whether blk is a UnixFS file, directory or symlink,
+// and the size of files. ok is false for blocks that are not UnixFS.
+func unixfsDataType(blk blocks.Block) (dataType string, size uint64, ok bool) {
+	switch mc.Code(blk.Cid().Prefix().Codec) {
+	case mc.Raw:
+		return "file", uint64(len(blk.RawData())), true
+	case mc.DagPb:
+		nd, err := dag.DecodeProtobuf(blk.RawData())
+		if err != nil {
+			return "", 0, false
+		}
+		fsn, err := ufs.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return "", 0, false
+		}
+		switch fsn.Type() {
+		case ufspb.Data_File, ufspb.Data_Raw:
+			return "file", fsn.FileSize(), true
+		case ufspb.Data_Directory, ufspb.Data_HAMTShard:
+			return "directory", 0, true
+		case ufspb.Data_Symlink:
+			return "symlink", 0, true
+		}
+	}
+	return "", 0, false
+}
+
+func (i *handler) setCommonHeaders(w http.ResponseWriter, r *http.Request, contentPath ipath.Path, cacheTier CacheTier) *requestError {
 	i.addUserHeaders(w) // ok, _now_ write user's headers.
 	w.Header().Set("X-Ipfs-Path", contentPath.String())
+	if cacheTier != "" {
+		w.Header().Set("X-Ipfs-Cache", string(cacheTier))
+	}
+	// The resolution of a mutable path may come from the ResolverCache, in
+	// which case the response is as old as the cached resolution
+	if cache, ok := i.config.ResolverCache.(AgingResolverCache); ok && !i.isImmutable(contentPath) {
+		if age, ok := cache.Age(contentPath); ok && age >= time.Second {
+			w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+		}
+	}
 
-	if rootCids, err := i.buildIpfsRootsHeader(contentPath.String(), r); err == nil {
+	// Clients that do not care about X-Ipfs-Roots can opt out of the
+	// per-segment path resolution it requires (RFC 7240). Both variants
+	// must be told apart by shared caches.
+	w.Header().Add("Vary", "Prefer")
+	// Unless the ?format query parameter picked it, the response format was
+	// negotiated with the Accept header. There is no compression, so
+	// Accept-Encoding does not change the response.
+	if _, ok := queryResponseFormat(r, !i.config.DisableFormatQueryParam); !ok {
+		w.Header().Add("Vary", "Accept")
+	}
+	if preferReturnMinimal(r) {
+		w.Header().Set("Preference-Applied", "return=minimal")
+	} else if rootCids, truncated, err := i.buildIpfsRootsHeader(contentPath.String(), r); err == nil {
 		w.Header().Set("X-Ipfs-Roots", rootCids)
+		if truncated {
+			w.Header().Set("X-Ipfs-Roots-Truncated", "true")
+		}
 	} else { // this should never happen, as we resolved the contentPath already
 		err = fmt.Errorf("error while resolving X-Ipfs-Roots: %w", err)
 		return newRequestError(err, http.StatusInternalServerError)
 	}
 
+	// Point clients and caches at the immutable equivalent of a mutable path.
+	// With origin isolation the /ipfs/ path would not be served from the
+	// request's origin, so it is only set on path gateway requests.
+	if contentPath.Mutable() && !hasOriginIsolation(r) {
+		if location, err := i.immutableContentLocation(r.Context(), contentPath); err == nil {
+			w.Header().Set("Content-Location", location)
+		} else {
+			log.Debugw("error while resolving Content-Location", "path", contentPath, "error", err)
+		}
+	}
+
 	return nil
 }
 
+// immutableContentLocation returns the /ipfs/ path equivalent to the mutable
+// contentPath, with the root of the /ipns/ name replaced by the CID it
+// currently resolves to.
+func (i *handler) immutableContentLocation(ctx context.Context, contentPath ipath.Path) (string, error) {
+	// /ipns/<name>/<subpath> → ["", "ipns", "<name>", "<subpath>"]
+	segments := strings.SplitN(contentPath.String(), "/", 4)
+	if len(segments) < 3 {
+		return "", fmt.Errorf("invalid path %q", contentPath)
+	}
+	root, err := i.resolvePath(ctx, ipath.New(ipnsPathPrefix+segments[2]))
+	if err != nil {
+		return "", err
+	}
+	location := ipfsPathPrefix + root.Cid().String()
+	if len(segments) == 4 {
+		location += "/" + segments[3]
+	}
+	return (&url.URL{Path: location}).EscapedPath(), nil
+}
+
+// preferReturnMinimal returns true if the request has 'Prefer: return=minimal'
+func preferReturnMinimal(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, value := range strings.Split(header, ",") {
+			// drop preference parameters, if any (e.g. return=minimal; foo=bar)
+			pref := strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+			if strings.EqualFold(pref, "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // spanTrace starts a new span using the standard IPFS tracing conventions.
 func spanTrace(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
 	return otel.Tracer("go-libipfs").Start(ctx, fmt.Sprintf("%s.%s", " Gateway", spanName), opts...)
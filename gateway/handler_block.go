@@ -3,10 +3,12 @@ package gateway
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	cid "github.com/ipfs/go-cid"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -21,14 +23,20 @@ func (i *handler) serveRawBlock(ctx context.Context, w http.ResponseWriter, r *h
 	block, err := i.api.GetBlock(ctx, blockCid)
 	if err != nil {
 		err = fmt.Errorf("error getting block %s: %w", blockCid.String(), err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
+	if i.config.VerifyBlocks {
+		if err := verifyBlock(blockCid, block.RawData()); err != nil {
+			i.webError(w, err, http.StatusBadGateway)
+			return false
+		}
+	}
 	content := bytes.NewReader(block.RawData())
 
 	// Set Content-Disposition
 	var name string
-	if urlFilename := r.URL.Query().Get("filename"); urlFilename != "" {
+	if urlFilename := i.urlFilename(r); urlFilename != "" {
 		name = urlFilename
 	} else {
 		name = blockCid.String() + ".bin"
@@ -36,18 +44,43 @@ func (i *handler) serveRawBlock(ctx context.Context, w http.ResponseWriter, r *h
 	setContentDispositionHeader(w, name, "attachment")
 
 	// Set remaining headers
-	modtime := addCacheControlHeaders(w, r, contentPath, blockCid)
+	modtime := i.addCacheControlHeaders(w, r, contentPath, blockCid)
 	w.Header().Set("Content-Type", "application/vnd.ipld.raw")
 	w.Header().Set("X-Content-Type-Options", "nosniff") // no funny business in the browsers :^)
 
+	// The block is what its CID hashes, so the digest is usually free
+	if digest, ok := cidReprDigest(blockCid); ok {
+		w.Header().Set("Repr-Digest", digest)
+	} else if int64(len(block.RawData())) <= i.config.ReprDigestMaxSize {
+		digest, _ := contentReprDigest(bytes.NewReader(block.RawData()))
+		w.Header().Set("Repr-Digest", digest)
+	}
+
 	// ServeContent will take care of
 	// If-None-Match+Etag, Content-Length and range requests
 	_, dataSent, _ := ServeContent(w, r, name, modtime, content)
 
 	if dataSent {
 		// Update metrics
-		i.rawBlockGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.rawBlockGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 	}
 
 	return dataSent
 }
+
+// errBlockMismatch is returned by verifyBlock when a block does not match
+// its CID.
+var errBlockMismatch = errors.New("block does not match its CID")
+
+// verifyBlock re-hashes data using the multihash function of c and checks
+// that the digest matches.
+func verifyBlock(c cid.Cid, data []byte) error {
+	got, err := c.Prefix().Sum(data)
+	if err != nil {
+		return fmt.Errorf("error hashing block %s: %w", c.String(), err)
+	}
+	if !bytes.Equal(got.Hash(), c.Hash()) {
+		return fmt.Errorf("%w: %s hashes to %s", errBlockMismatch, c.String(), got.String())
+	}
+	return nil
+}
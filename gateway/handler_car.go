@@ -1,20 +1,45 @@
 package gateway
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	cid "github.com/ipfs/go-cid"
 	blocks "github.com/ipfs/go-libipfs/blocks"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	gocar "github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
 	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
+// CARStore keeps precomputed CAR responses, e.g. for pinned content that is
+// requested often. Keys identify a CAR by the CIDs from the content root
+// down to the requested entity, joined with "/", so that they are the same
+// for every content path resolving to the same blocks.
+type CARStore interface {
+	// Get returns the CAR stored under key and its size in bytes. ok is
+	// false when there is none.
+	Get(ctx context.Context, key string) (car io.ReadCloser, size int64, ok bool, err error)
+
+	// Put stores the CAR read from r under key. The CAR is complete only if
+	// r is read to io.EOF, implementations must discard it on other errors.
+	// Put may also ignore CARs it doesn't want to keep.
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
 // serveCAR returns a CAR stream for specific DAG+selector
 func (i *handler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path, carVersion string, begin time.Time) bool {
 	ctx, span := spanTrace(ctx, "ServeCAR", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
@@ -28,14 +53,14 @@ func (i *handler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	case "1": // noop, we support this
 	default:
 		err := fmt.Errorf("unsupported CAR version: only version=1 is supported")
-		webError(w, err, http.StatusBadRequest)
+		i.webError(w, err, http.StatusBadRequest)
 		return false
 	}
 	rootCid := resolvedPath.Cid()
 
 	// Set Content-Disposition
 	var name string
-	if urlFilename := r.URL.Query().Get("filename"); urlFilename != "" {
+	if urlFilename := i.urlFilename(r); urlFilename != "" {
 		name = urlFilename
 	} else {
 		name = rootCid.String() + ".car"
@@ -43,14 +68,14 @@ func (i *handler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	setContentDispositionHeader(w, name, "attachment")
 
 	// Set Cache-Control (same logic as for a regular files)
-	addCacheControlHeaders(w, r, contentPath, rootCid)
+	i.addCacheControlHeaders(w, r, contentPath, rootCid)
 
 	// Weak Etag W/ because we can't guarantee byte-for-byte identical
 	// responses, but still want to benefit from HTTP Caching. Two CAR
 	// responses for the same CID and selector will be logically equivalent,
 	// but when CAR is streamed, then in theory, blocks may arrive from
 	// datastore in non-deterministic order.
-	etag := `W/` + getEtag(r, rootCid)
+	etag := `W/` + i.getEtag(r, rootCid)
 	w.Header().Set("Etag", etag)
 
 	// Finish early if Etag match
@@ -59,6 +84,16 @@ func (i *handler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.R
 		return false
 	}
 
+	// The CAR root is the requested entity, but for sub-path requests the
+	// blocks on the path leading to it are sent first, so that clients can
+	// verify the path from the content root down to the entity.
+	pathRoots, err := i.resolvePathRoots(ctx, contentPath.String())
+	if err != nil {
+		err = fmt.Errorf("error getting path blocks for %s: %w", debugStr(contentPath.String()), err)
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
 	// Make it clear we don't support range-requests over a car stream
 	// Partial downloads and resumes should be handled using requests for
 	// sub-DAGs and IPLD selectors: https://github.com/ipfs/go-ipfs/issues/8769
@@ -67,33 +102,307 @@ func (i *handler) serveCAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	w.Header().Set("Content-Type", "application/vnd.ipld.car; version=1")
 	w.Header().Set("X-Content-Type-Options", "nosniff") // no funny business in the browsers :^)
 
+	var storeKey string
+	if i.config.CARStore != nil {
+		storeKey = carStoreKey(pathRoots)
+		served, err := i.serveStoredCAR(ctx, w, storeKey)
+		if err != nil {
+			err = fmt.Errorf("error getting stored CAR for %s: %w", debugStr(contentPath.String()), err)
+			i.webError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		if served {
+			i.carStreamGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+			return true
+		}
+	}
+
+	pathBlocks, err := i.carPathBlocks(ctx, pathRoots)
+	if err != nil {
+		err = fmt.Errorf("error getting path blocks for %s: %w", debugStr(contentPath.String()), err)
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	// Announce the trailer reporting errors that happen after the 200 OK
+	// was sent, so that clients can tell a truncated CAR from a complete one
+	w.Header().Set("Trailer", "X-Stream-Error")
+
 	// Same go-car settings as dag.export command
-	store := dagStore{api: i.api, ctx: ctx}
+	store := newDagStore(ctx, i.api, i.config.MaxTraversalDepth, i.config.VerifyBlocks)
 
 	// TODO: support selectors passed as request param: https://github.com/ipfs/kubo/issues/8769
 	dag := gocar.Dag{Root: rootCid, Selector: selectorparse.CommonSelector_ExploreAllRecursively}
 	car := gocar.NewSelectiveCar(ctx, store, []gocar.Dag{dag}, gocar.TraverseLinksOnlyOnce())
 
-	if err := car.Write(w); err != nil {
-		// We return error as a trailer, however it is not something browsers can access
+	var out io.Writer = w
+	var stored *carStorePut
+	if i.config.CARStore != nil {
+		stored = i.startCARStorePut(ctx, storeKey)
+		out = io.MultiWriter(w, stored)
+	}
+
+	err = writeCAR(out, car, rootCid, pathBlocks)
+	if stored != nil {
+		stored.finish(err)
+	}
+	if err != nil {
+		// We return error as the trailer announced above, however it is not something browsers can access
 		// (https://github.com/mdn/browser-compat-data/issues/14703)
 		// Due to this, we suggest client always verify that
 		// the received CAR stream response is matching requested DAG selector
 		w.Header().Set("X-Stream-Error", err.Error())
+		if errors.Is(err, errBlockMismatch) {
+			// Ending the response normally would make the truncated CAR
+			// look complete, abort the connection instead
+			log.Warnw("car stream aborted on a corrupt block", "path", contentPath, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		if errors.Is(err, ErrMaxTraversalDepth) {
+			// Same as above, the trailer alone doesn't reach most clients
+			log.Debugw("car stream aborted at max traversal depth", "path", contentPath, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+		log.Debugw("car stream aborted", "path", contentPath, "error", err)
 		return false
 	}
 
 	// Update metrics
-	i.carStreamGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+	i.carStreamGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 	return true
 }
 
+// serveStoredCAR sends the CAR stored under key, if any. It reports whether
+// it did; errors are only returned before anything was written.
+func (i *handler) serveStoredCAR(ctx context.Context, w http.ResponseWriter, key string) (bool, error) {
+	car, size, ok, err := i.config.CARStore.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer car.Close()
+
+	// The size is known upfront, so there is no need for the error trailer
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, car); err != nil {
+		log.Debugw("stored car stream aborted", "key", key, "error", err)
+	}
+	return true, nil
+}
+
+// carStoreKey returns the CARStore key of the CAR for the given path roots.
+func carStoreKey(pathRoots []cid.Cid) string {
+	keys := make([]string, len(pathRoots))
+	for i, c := range pathRoots {
+		keys[i] = c.String()
+	}
+	return strings.Join(keys, "/")
+}
+
+// carStorePut feeds a CAR being generated to CARStore.Put.
+type carStorePut struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	// failed is set once Put stopped reading, later writes are dropped so
+	// that the response itself is not affected
+	failed bool
+}
+
+func (i *handler) startCARStorePut(ctx context.Context, key string) *carStorePut {
+	pr, pw := io.Pipe()
+	p := &carStorePut{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		err := i.config.CARStore.Put(ctx, key, pr)
+		if err != nil {
+			log.Debugw("storing car failed", "key", key, "error", err)
+		}
+		// Unblock the writer if Put returned without reading everything
+		pr.CloseWithError(errCARStoreClosed)
+	}()
+	return p
+}
+
+var errCARStoreClosed = errors.New("car store put returned")
+
+func (p *carStorePut) Write(b []byte) (int, error) {
+	if !p.failed {
+		if _, err := p.pw.Write(b); err != nil {
+			p.failed = true
+		}
+	}
+	return len(b), nil
+}
+
+// finish ends the CAR passed to Put, which sees err if generating it
+// failed, and waits for Put to return.
+func (p *carStorePut) finish(err error) {
+	p.pw.CloseWithError(err)
+	<-p.done
+}
+
+// carPathBlocks returns the blocks of pathRoots, from the content root down
+// to, but excluding, the requested entity. Blocks of HAMT shards crossed
+// within a directory are not included.
+func (i *handler) carPathBlocks(ctx context.Context, pathRoots []cid.Cid) ([]blocks.Block, error) {
+	if len(pathRoots) < 2 {
+		return nil, nil
+	}
+
+	pathBlocks := make([]blocks.Block, 0, len(pathRoots)-1)
+	for _, c := range pathRoots[:len(pathRoots)-1] {
+		blk, err := i.api.GetBlock(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if i.config.VerifyBlocks {
+			if err := verifyBlock(c, blk.RawData()); err != nil {
+				return nil, err
+			}
+		}
+		pathBlocks = append(pathBlocks, blk)
+	}
+	return pathBlocks, nil
+}
+
+// writeCAR writes car to w, inserting pathBlocks right after the header.
+func writeCAR(w io.Writer, car gocar.SelectiveCar, root cid.Cid, pathBlocks []blocks.Block) error {
+	if len(pathBlocks) == 0 {
+		return car.Write(w)
+	}
+
+	header := gocar.CarHeader{Roots: []cid.Cid{root}, Version: 1}
+	headerSize, err := gocar.HeaderSize(&header)
+	if err != nil {
+		return err
+	}
+	if err := gocar.WriteHeader(&header, w); err != nil {
+		return err
+	}
+	for _, blk := range pathBlocks {
+		if err := util.LdWrite(w, blk.Cid().Bytes(), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	// The selective CAR writes the same header again, skip it
+	return car.Write(&skipWriter{w: w, skip: headerSize})
+}
+
+// skipWriter discards the first skip bytes written to it.
+type skipWriter struct {
+	w    io.Writer
+	skip uint64
+}
+
+func (sw *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if sw.skip > 0 {
+		if uint64(n) <= sw.skip {
+			sw.skip -= uint64(n)
+			return n, nil
+		}
+		p = p[sw.skip:]
+		sw.skip = 0
+	}
+	if _, err := sw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 // FIXME(@Jorropo): https://github.com/ipld/go-car/issues/315
 type dagStore struct {
 	api API
 	ctx context.Context
+
+	// maxDepth, when positive, bounds the number of links followed from the
+	// root. depths records how deep each CID seen as a link of a fetched
+	// block is, so the limit can be enforced before fetching it.
+	maxDepth int
+	depths   map[cid.Cid]int
+
+	// verify makes every fetched block be checked against its CID
+	verify bool
+}
+
+func newDagStore(ctx context.Context, api API, maxDepth int, verify bool) dagStore {
+	return dagStore{
+		api:      api,
+		ctx:      ctx,
+		maxDepth: maxDepth,
+		depths:   make(map[cid.Cid]int),
+		verify:   verify,
+	}
 }
 
 func (ds dagStore) Get(_ context.Context, c cid.Cid) (blocks.Block, error) {
-	return ds.api.GetBlock(ds.ctx, c)
+	if ds.maxDepth <= 0 {
+		return ds.getBlock(c)
+	}
+
+	depth := ds.depths[c] // the root is not a link of anything, so 0
+	if depth > ds.maxDepth {
+		return nil, fmt.Errorf("%w: %s is %d links away from the root (max %d)", ErrMaxTraversalDepth, c, depth, ds.maxDepth)
+	}
+
+	blk, err := ds.getBlock(c)
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := blockLinks(blk)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if d, ok := ds.depths[l]; !ok || depth+1 < d {
+			ds.depths[l] = depth + 1
+		}
+	}
+	return blk, nil
+}
+
+func (ds dagStore) getBlock(c cid.Cid) (blocks.Block, error) {
+	blk, err := ds.api.GetBlock(ds.ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if ds.verify {
+		if err := verifyBlock(c, blk.RawData()); err != nil {
+			return nil, err
+		}
+	}
+	return blk, nil
+}
+
+// blockLinks decodes the block using the codec from its CID and returns
+// the CIDs it links to.
+func blockLinks(blk blocks.Block) ([]cid.Cid, error) {
+	codec := blk.Cid().Prefix().Codec
+	if codec == cid.Raw {
+		return nil, nil
+	}
+
+	decoder, err := multicodec.LookupDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decoder(nb, bytes.NewReader(blk.RawData())); err != nil {
+		return nil, err
+	}
+
+	links, err := traversal.SelectLinks(nb.Build())
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]cid.Cid, 0, len(links))
+	for _, l := range links {
+		if cl, ok := l.(cidlink.Link); ok {
+			cids = append(cids, cl.Cid)
+		}
+	}
+	return cids, nil
 }
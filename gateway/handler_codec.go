@@ -63,25 +63,34 @@ func (i *handler) serveCodec(ctx context.Context, w http.ResponseWriter, r *http
 	if resolvedPath.Remainder() != "" {
 		path := strings.TrimSuffix(resolvedPath.String(), resolvedPath.Remainder())
 		err := fmt.Errorf("%q of %q could not be returned: reading IPLD Kinds other than Links (CBOR Tag 42) is not implemented: try reading %q instead", resolvedPath.Remainder(), resolvedPath.String(), path)
-		webError(w, err, http.StatusNotImplemented)
+		i.webError(w, err, http.StatusNotImplemented)
 		return false
 	}
 
 	// If no explicit content type was requested, the response will have one based on the codec from the CID
+	var toCodec mc.Code
+	raw := true
 	if requestedContentType == "" {
 		cidContentType, ok := codecToContentType[cidCodec]
 		if !ok {
 			// Should not happen unless function is called with wrong parameters.
 			err := fmt.Errorf("content type not found for codec: %v", cidCodec)
-			webError(w, err, http.StatusInternalServerError)
+			i.webError(w, err, http.StatusInternalServerError)
 			return false
 		}
 		responseContentType = cidContentType
+	} else {
+		var err error
+		responseContentType, toCodec, raw, err = codecResponse(cidCodec, requestedContentType)
+		if err != nil {
+			webNotAcceptable(w, r, err)
+			return false
+		}
 	}
 
 	// Set HTTP headers (for caching etc)
-	modtime := addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
-	name := setCodecContentDisposition(w, r, resolvedPath, responseContentType)
+	modtime := i.addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
+	name := i.setCodecContentDisposition(w, r, resolvedPath, responseContentType)
 	w.Header().Set("Content-Type", responseContentType)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 
@@ -101,29 +110,56 @@ func (i *handler) serveCodec(ctx context.Context, w http.ResponseWriter, r *http
 		}
 	}
 
+	if raw {
+		return i.serveCodecRaw(ctx, w, r, resolvedPath, contentPath, name, modtime, begin)
+	}
+
+	// This handles DAG-* conversions and validations.
+	return i.serveCodecConverted(ctx, w, r, resolvedPath, contentPath, toCodec, modtime, begin)
+}
+
+// codecResponse decides how a block with cidCodec is returned when
+// requestedContentType was explicitly asked for. It returns the content type
+// of the response and whether the block is sent as-is, or otherwise the codec
+// it is converted to. The outcome for the codecs the gateway knows is:
+//
+//	block \ requested  json    cbor    dag-json  dag-cbor
+//	json               as-is   406     as-is     406
+//	cbor               406     as-is   406       as-is
+//	dag-json           as-is   406     convert   convert
+//	dag-cbor           406     as-is   convert   convert
+//
+// Plain JSON and CBOR have no links, so their DAG-* variant of the same
+// serialization is sent as-is with the plain content type, while converting
+// them to the other serialization could make data be read as links. Other
+// codecs, such as dag-pb, are converted to the requested DAG-* codec.
+func codecResponse(cidCodec mc.Code, requestedContentType string) (contentType string, toCodec mc.Code, raw bool, err error) {
 	// If DAG-JSON or DAG-CBOR was requested using corresponding plain content type
 	// return raw block as-is, without conversion
-	skipCodecs, ok := contentTypeToRaw[requestedContentType]
-	if ok {
+	if skipCodecs, ok := contentTypeToRaw[requestedContentType]; ok {
 		for _, skipCodec := range skipCodecs {
 			if skipCodec == cidCodec {
-				return i.serveCodecRaw(ctx, w, r, resolvedPath, contentPath, name, modtime, begin)
+				return requestedContentType, 0, true, nil
 			}
 		}
+		return "", 0, false, fmt.Errorf("%s block can't be returned as %s: request %s instead", cidCodec, requestedContentType, codecToContentType[cidCodec])
 	}
 
 	// Otherwise, the user has requested a specific content type (a DAG-* variant).
 	// Let's first get the codecs that can be used with this content type.
 	toCodec, ok := contentTypeToCodec[requestedContentType]
 	if !ok {
-		// This is never supposed to happen unless function is called with wrong parameters.
-		err := fmt.Errorf("unsupported content type: %q", requestedContentType)
-		webError(w, err, http.StatusInternalServerError)
-		return false
+		return "", 0, false, fmt.Errorf("unsupported content type: %q", requestedContentType)
 	}
 
-	// This handles DAG-* conversions and validations.
-	return i.serveCodecConverted(ctx, w, r, resolvedPath, contentPath, toCodec, modtime, begin)
+	switch cidCodec {
+	case mc.Json, mc.Cbor:
+		if (cidCodec == mc.Json) == (toCodec == mc.DagJson) {
+			return codecToContentType[cidCodec], 0, true, nil
+		}
+		return "", 0, false, fmt.Errorf("%s block can't be converted to %s: request %s instead", cidCodec, requestedContentType, codecToContentType[cidCodec])
+	}
+	return requestedContentType, toCodec, false, nil
 }
 
 func (i *handler) serveCodecHTML(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path) bool {
@@ -151,7 +187,7 @@ func (i *handler) serveCodecHTML(ctx context.Context, w http.ResponseWriter, r *
 		CodecHex:  fmt.Sprintf("0x%x", uint64(cidCodec)),
 	}); err != nil {
 		err = fmt.Errorf("failed to generate HTML listing for this DAG: try fetching raw block with ?format=raw: %w", err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
@@ -164,7 +200,7 @@ func (i *handler) serveCodecRaw(ctx context.Context, w http.ResponseWriter, r *h
 	block, err := i.api.GetBlock(ctx, blockCid)
 	if err != nil {
 		err = fmt.Errorf("error getting block %s: %w", blockCid.String(), err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 	content := bytes.NewReader(block.RawData())
@@ -175,7 +211,7 @@ func (i *handler) serveCodecRaw(ctx context.Context, w http.ResponseWriter, r *h
 
 	if dataSent {
 		// Update metrics
-		i.jsoncborDocumentGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.jsoncborDocumentGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 	}
 
 	return dataSent
@@ -187,27 +223,27 @@ func (i *handler) serveCodecConverted(ctx context.Context, w http.ResponseWriter
 	block, err := i.api.GetBlock(ctx, blockCid)
 	if err != nil {
 		err = fmt.Errorf("error getting block %s: %w", blockCid.String(), err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
 	codec := blockCid.Prefix().Codec
 	decoder, err := multicodec.LookupDecoder(codec)
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
 	node := basicnode.Prototype.Any.NewBuilder()
 	err = decoder(node, bytes.NewReader(block.RawData()))
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
 	encoder, err := multicodec.LookupEncoder(uint64(toCodec))
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
@@ -215,7 +251,7 @@ func (i *handler) serveCodecConverted(ctx context.Context, w http.ResponseWriter
 	var buf bytes.Buffer
 	err = encoder(node.Build(), &buf)
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
@@ -228,14 +264,14 @@ func (i *handler) serveCodecConverted(ctx context.Context, w http.ResponseWriter
 	_, err = w.Write(buf.Bytes())
 	if err == nil {
 		// Update metrics
-		i.jsoncborDocumentGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.jsoncborDocumentGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 		return true
 	}
 
 	return false
 }
 
-func setCodecContentDisposition(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentType string) string {
+func (i *handler) setCodecContentDisposition(w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentType string) string {
 	var dispType, name string
 
 	ext, ok := contentTypeToExtension[contentType]
@@ -244,7 +280,7 @@ func setCodecContentDisposition(w http.ResponseWriter, r *http.Request, resolved
 		ext = ".bin"
 	}
 
-	if urlFilename := r.URL.Query().Get("filename"); urlFilename != "" {
+	if urlFilename := i.urlFilename(r); urlFilename != "" {
 		name = urlFilename
 	} else {
 		name = resolvedPath.Cid().String() + ext
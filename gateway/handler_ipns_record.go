@@ -2,7 +2,7 @@ package gateway
 
 import (
 	"context"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -12,64 +12,114 @@ import (
 	"github.com/ipfs/go-cid"
 	ipns_pb "github.com/ipfs/go-ipns/pb"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	mh "github.com/multiformats/go-multihash"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// ipnsRecordSummary is the response body of ?format=ipns-record-json, a
+// readable view of the record. Validity is the end of life of the record,
+// and TTL its time to live in seconds, when set.
+type ipnsRecordSummary struct {
+	Sequence uint64 `json:"sequence"`
+	Validity string `json:"validity,omitempty"`
+	TTL      *int64 `json:"ttl,omitempty"`
+	Value    string `json:"value"`
+}
+
 func (i *handler) serveIpnsRecord(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path, begin time.Time, logger *zap.SugaredLogger) bool {
 	ctx, span := spanTrace(ctx, "ServeIPNSRecord", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
 	defer span.End()
 
 	if contentPath.Namespace() != "ipns" {
 		err := fmt.Errorf("%s is not an IPNS link", contentPath.String())
-		webError(w, err, http.StatusBadRequest)
+		i.webError(w, err, http.StatusBadRequest)
 		return false
 	}
 
-	key := contentPath.String()
-	key = strings.TrimSuffix(key, "/")
-	key = strings.TrimPrefix(key, "/ipns/")
-	if strings.Count(key, "/") != 0 {
-		err := errors.New("cannot find ipns key for subpath")
-		webError(w, err, http.StatusBadRequest)
+	if err := checkIpnsRecordPath(contentPath); err != nil {
+		i.webError(w, err, http.StatusBadRequest)
 		return false
 	}
+	key := strings.TrimPrefix(strings.TrimSuffix(contentPath.String(), "/"), "/ipns/")
 
 	c, err := cid.Decode(key)
 	if err != nil {
-		webError(w, err, http.StatusBadRequest)
+		i.webError(w, err, http.StatusBadRequest)
 		return false
 	}
 
 	rawRecord, err := i.api.GetIPNSRecord(ctx, c)
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
 	var record ipns_pb.IpnsEntry
 	err = proto.Unmarshal(rawRecord, &record)
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
+	// The Etag is derived from the record bytes, so that clients polling a
+	// name get a 304 until the record is actually republished with changes.
+	recordCid, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum(rawRecord)
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+	etag := i.getEtag(r, recordCid)
+	w.Header().Set("Etag", etag)
+
 	// Set cache control headers based on the TTL set in the IPNS record. If the
 	// TTL is not present, we use the Last-Modified tag. We are tracking IPNS
 	// caching on: https://github.com/ipfs/kubo/issues/1818.
 	// TODO: use addCacheControlHeaders once #1818 is fixed.
-	w.Header().Set("Etag", getEtag(r, resolvedPath.Cid()))
 	if record.Ttl != nil {
 		seconds := int(time.Duration(*record.Ttl).Seconds())
 		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", seconds))
 	} else {
-		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", i.now().UTC().Format(http.TimeFormat))
+	}
+
+	// A 304 carries the same caching headers the full response would
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, etag, "") {
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+
+	// The JSON summary is for reading, it is not downloaded like the record
+	if responseFormat, _, _ := customResponseFormat(r, !i.config.DisableFormatQueryParam); responseFormat == "application/vnd.ipfs.ipns-record+json" {
+		summary := ipnsRecordSummary{
+			Sequence: record.GetSequence(),
+			Value:    string(record.GetValue()),
+		}
+		if record.GetValidityType() == ipns_pb.IpnsEntry_EOL {
+			summary.Validity = string(record.GetValidity())
+		}
+		if record.Ttl != nil {
+			ttl := int64(time.Duration(*record.Ttl).Seconds())
+			summary.TTL = &ttl
+		}
+		body, err := json.Marshal(summary)
+		if err != nil {
+			i.webError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		w.Header().Set("Content-Type", "application/vnd.ipfs.ipns-record+json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		_, err = w.Write(body)
+		if err == nil {
+			i.ipnsRecordGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+		}
+		return err == nil
 	}
 
 	// Set Content-Disposition
 	var name string
-	if urlFilename := r.URL.Query().Get("filename"); urlFilename != "" {
+	if urlFilename := i.urlFilename(r); urlFilename != "" {
 		name = urlFilename
 	} else {
 		name = key + ".ipns-record"
@@ -82,9 +132,19 @@ func (i *handler) serveIpnsRecord(ctx context.Context, w http.ResponseWriter, r
 	_, err = w.Write(rawRecord)
 	if err == nil {
 		// Update metrics
-		i.ipnsRecordGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.ipnsRecordGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 		return true
 	}
 
 	return false
 }
+
+// checkIpnsRecordPath returns an error when contentPath points below the root
+// of an IPNS name: records are published for names, not for their sub-paths.
+func checkIpnsRecordPath(contentPath ipath.Path) error {
+	key := strings.TrimPrefix(strings.TrimSuffix(contentPath.String(), "/"), "/ipns/")
+	if strings.Contains(key, "/") {
+		return fmt.Errorf("IPNS records can only be requested for the root of a name, not for the sub-path %s", debugStr(contentPath.String()))
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// resolveResult is the response body of ?format=resolve.
+type resolveResult struct {
+	Cid  string `json:"cid"`
+	Path string `json:"path"`
+}
+
+// serveResolve returns the CID contentPath resolved to as JSON, without
+// fetching the content itself.
+func (i *handler) serveResolve(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path, begin time.Time) bool {
+	_, span := spanTrace(ctx, "ServeResolve", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
+	defer span.End()
+
+	body, err := json.Marshal(resolveResult{
+		Cid:  resolvedPath.Cid().String(),
+		Path: contentPath.String(),
+	})
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	i.addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
+	w.Header().Set("Content-Type", "application/vnd.ipfs.resolve+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = w.Write(body)
+	if err == nil {
+		i.resolveGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+	}
+	return err == nil
+}
@@ -0,0 +1,46 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// servePlan is the response body of ?debug=serve-plan: how the handler
+// would answer the request, see Config.Debug.
+type servePlan struct {
+	ContentPath    string      `json:"contentPath"`
+	ResolvedPath   string      `json:"resolvedPath"`
+	Cid            string      `json:"cid"`
+	ResponseFormat string      `json:"responseFormat,omitempty"`
+	Handler        string      `json:"handler,omitempty"`
+	Headers        http.Header `json:"headers"`
+}
+
+// serveServePlan replies with the servePlan of the request instead of
+// serving it. Headers are the ones computed so far, before the branch serving
+// the content adds its own.
+func (i *handler) serveServePlan(w http.ResponseWriter, resolvedPath ipath.Resolved, contentPath ipath.Path, responseFormat, branch string) {
+	body, err := json.Marshal(servePlan{
+		ContentPath:    contentPath.String(),
+		ResolvedPath:   resolvedPath.String(),
+		Cid:            resolvedPath.Cid().String(),
+		ResponseFormat: responseFormat,
+		Handler:        branch,
+		Headers:        w.Header().Clone(),
+	})
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The plan describes the content, it must not be cached in its place
+	for _, h := range []string{"Etag", "Last-Modified", "Content-Disposition", "Content-Length"} {
+		w.Header().Del(h)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(body)
+}
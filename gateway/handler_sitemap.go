@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"strings"
+
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sitemapCacheSize is the number of sites whose sitemap paths are kept.
+const sitemapCacheSize = 64
+
+// sitemapURLSet is the XML document of a sitemap, see
+// https://www.sitemaps.org/protocol.html
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc string `xml:"loc"`
+}
+
+// serveSitemapIfRequested serves a generated sitemap when the request is for
+// /sitemap.xml on a DNSLink host whose site has none, see
+// Config.SitemapMaxEntries. Returns true when it handled the request.
+func (i *handler) serveSitemapIfRequested(w http.ResponseWriter, r *http.Request, contentPath ipath.Path) bool {
+	if i.config.SitemapMaxEntries <= 0 {
+		return false
+	}
+	host, ok := r.Context().Value(DNSLinkHostnameKey).(string)
+	if !ok {
+		return false
+	}
+	rootPath := ipnsPathPrefix + stripPort(host)
+	if contentPath.String() != rootPath+"/sitemap.xml" {
+		return false
+	}
+
+	ctx, span := spanTrace(r.Context(), "ServeSitemap", trace.WithAttributes(attribute.String("path", rootPath)))
+	defer span.End()
+
+	root, err := i.resolvePath(ctx, ipath.New(rootPath))
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return true
+	}
+	paths, err := i.sitemapPaths(ctx, root)
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return true
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if i.config.TrustXForwardedHeaders {
+		if proto := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]); proto != "" {
+			scheme = proto
+		}
+	}
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, p := range paths {
+		loc := url.URL{Scheme: scheme, Host: host, Path: p}
+		set.URLs = append(set.URLs, sitemapURL{Loc: loc.String()})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(set); err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Etag", `"Sitemap-`+root.Cid().String()+`"`)
+	if r.Method == http.MethodHead {
+		return true
+	}
+	_, _ = w.Write(buf.Bytes())
+	return true
+}
+
+// sitemapPaths returns the URL paths of the HTML pages of the site rooted at
+// root, with directories standing for their index.html. The UnixFS tree is
+// walked breadth first, bounded by Config.SitemapMaxEntries and
+// Config.SitemapMaxDepth, and the result is cached by root CID.
+func (i *handler) sitemapPaths(ctx context.Context, root ipath.Resolved) ([]string, error) {
+	if v, ok := i.sitemaps.Get(root.Cid()); ok {
+		return v.([]string), nil
+	}
+
+	type dir struct {
+		path    ipath.Resolved
+		urlPath string
+		depth   int
+	}
+	queue := []dir{{root, "/", 0}}
+	paths := []string{}
+	visited := 0
+	for len(queue) > 0 && visited < i.config.SitemapMaxEntries {
+		d := queue[0]
+		queue = queue[1:]
+
+		lsCtx, cancel := context.WithCancel(ctx)
+		entries, err := i.api.LsUnixFsDir(lsCtx, d.path)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for entry := range entries {
+			if entry.Err != nil {
+				cancel()
+				return nil, entry.Err
+			}
+			if visited++; visited > i.config.SitemapMaxEntries {
+				log.Debugw("sitemap truncated", "root", root.Cid(), "entries", i.config.SitemapMaxEntries)
+				break
+			}
+
+			switch ext := strings.ToLower(gopath.Ext(entry.Name)); {
+			case entry.Type == iface.TDirectory:
+				if maxDepth := i.config.SitemapMaxDepth; maxDepth == 0 || d.depth < maxDepth {
+					queue = append(queue, dir{ipath.IpfsPath(entry.Cid), d.urlPath + entry.Name + "/", d.depth + 1})
+				}
+			case entry.Name == "index.html":
+				paths = append(paths, d.urlPath)
+			case ext == ".html" || ext == ".htm":
+				paths = append(paths, d.urlPath+entry.Name)
+			}
+		}
+		cancel()
+	}
+
+	i.sitemaps.Add(root.Cid(), paths)
+	return paths, nil
+}
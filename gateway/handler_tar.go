@@ -27,7 +27,7 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	file, err := i.api.GetUnixFsNode(ctx, resolvedPath)
 	if err != nil {
 		err = fmt.Errorf("error getting UnixFS node for %s: %w", html.EscapeString(contentPath.String()), err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 	defer file.Close()
@@ -35,14 +35,14 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	rootCid := resolvedPath.Cid()
 
 	// Set Cache-Control and read optional Last-Modified time
-	modtime := addCacheControlHeaders(w, r, contentPath, rootCid)
+	modtime := i.addCacheControlHeaders(w, r, contentPath, rootCid)
 
 	// Weak Etag W/ because we can't guarantee byte-for-byte identical
 	// responses, but still want to benefit from HTTP Caching. Two TAR
 	// responses for the same CID will be logically equivalent,
 	// but when TAR is streamed, then in theory, files and directories
 	// may arrive in different order (depends on TAR lib and filesystem/inodes).
-	etag := `W/` + getEtag(r, rootCid)
+	etag := `W/` + i.getEtag(r, rootCid)
 	w.Header().Set("Etag", etag)
 
 	// Finish early if Etag match
@@ -53,7 +53,7 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 
 	// Set Content-Disposition
 	var name string
-	if urlFilename := r.URL.Query().Get("filename"); urlFilename != "" {
+	if urlFilename := i.urlFilename(r); urlFilename != "" {
 		name = urlFilename
 	} else {
 		name = rootCid.String() + ".tar"
@@ -63,7 +63,7 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	// Construct the TAR writer
 	tarw, err := files.NewTarWriter(w)
 	if err != nil {
-		webError(w, fmt.Errorf("could not build tar writer: %w", err), http.StatusInternalServerError)
+		i.webError(w, fmt.Errorf("could not build tar writer: %w", err), http.StatusInternalServerError)
 		return false
 	}
 	defer tarw.Close()
@@ -78,8 +78,13 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	w.Header().Set("Content-Type", "application/x-tar")
 	w.Header().Set("X-Content-Type-Options", "nosniff") // no funny business in the browsers :^)
 
+	var node files.Node = file
+	if dir, ok := file.(files.Directory); ok && i.config.MaxTraversalDepth > 0 {
+		node = &depthLimitedDirectory{Directory: dir, maxDepth: i.config.MaxTraversalDepth}
+	}
+
 	// The TAR has a top-level directory (or file) named by the CID.
-	if err := tarw.WriteFile(file, rootCid.String()); err != nil {
+	if err := tarw.WriteFile(node, rootCid.String()); err != nil {
 		w.Header().Set("X-Stream-Error", err.Error())
 		// Trailer headers do not work in web browsers
 		// (see https://github.com/mdn/browser-compat-data/issues/14703)
@@ -92,6 +97,55 @@ func (i *handler) serveTAR(ctx context.Context, w http.ResponseWriter, r *http.R
 	}
 
 	// Update metrics
-	i.tarStreamGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+	i.tarStreamGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+	return true
+}
+
+// depthLimitedDirectory wraps a files.Directory and makes iteration fail
+// once an entry more than maxDepth directories below the root is reached.
+type depthLimitedDirectory struct {
+	files.Directory
+	depth    int
+	maxDepth int
+}
+
+func (d *depthLimitedDirectory) Entries() files.DirIterator {
+	return &depthLimitedIterator{
+		DirIterator: d.Directory.Entries(),
+		depth:       d.depth + 1,
+		maxDepth:    d.maxDepth,
+	}
+}
+
+type depthLimitedIterator struct {
+	files.DirIterator
+	depth    int
+	maxDepth int
+	err      error
+}
+
+func (it *depthLimitedIterator) Next() bool {
+	if it.err != nil || !it.DirIterator.Next() {
+		return false
+	}
+	if it.depth > it.maxDepth {
+		it.err = fmt.Errorf("%w: %q is nested more than %d directories deep", ErrMaxTraversalDepth, it.Name(), it.maxDepth)
+		return false
+	}
 	return true
 }
+
+func (it *depthLimitedIterator) Node() files.Node {
+	nd := it.DirIterator.Node()
+	if dir, ok := nd.(files.Directory); ok {
+		return &depthLimitedDirectory{Directory: dir, depth: it.depth, maxDepth: it.maxDepth}
+	}
+	return nd
+}
+
+func (it *depthLimitedIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.DirIterator.Err()
+}
@@ -1,17 +1,32 @@
 package gateway
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-libipfs/blocks"
 	"github.com/ipfs/go-libipfs/files"
 	iface "github.com/ipfs/interface-go-ipfs-core"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/tj/assert"
+	"github.com/ucarion/urlpath"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestEtagMatch(t *testing.T) {
@@ -39,6 +54,29 @@ func TestEtagMatch(t *testing.T) {
 	}
 }
 
+func TestEtagIfMatch(t *testing.T) {
+	for _, test := range []struct {
+		header   string // value in If-Match HTTP header
+		cidEtag  string
+		dirEtag  string
+		expected bool // expected result of etagIfMatch(header, cidEtag, dirEtag)
+	}{
+		{`"etag"`, `"etag"`, "", true},        // file etag match
+		{`"foo", "etag"`, `"etag"`, "", true}, // file etag match (array)
+		{`"other"`, `"etag"`, "", false},      // no match
+		{`W/"etag"`, `"etag"`, "", false},     // weak etags never match
+		{`"etag"`, "", `W/"etag"`, false},     // weak dir etag never matches
+		{`"etag"`, `"other"`, `"etag"`, true}, // dir etag match
+		{`*`, `"etag"`, "", true},             // wildcard etag match
+		{`invalid`, `"etag"`, "", false},      // malformed header
+	} {
+		result := etagIfMatch(test.header, test.cidEtag, test.dirEtag)
+		if result != test.expected {
+			t.Fatalf("unexpected result of etagIfMatch(%q, %q, %q), got %t, expected %t", test.header, test.cidEtag, test.dirEtag, result, test.expected)
+		}
+	}
+}
+
 type errorMockAPI struct {
 	err error
 }
@@ -110,3 +148,650 @@ func TestBadGatewayBubblingFromAPI(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, http.StatusBadGateway, res.StatusCode)
 }
+
+func TestDagStoreMaxDepth(t *testing.T) {
+	api, root := newMockAPI(t)
+	ctx := context.Background()
+
+	deep, err := api.ResolvePath(ctx, ipath.Join(ipath.IpfsPath(root), "TestIPNSHostnameBacklinks", "foo? #<'"))
+	assert.Nil(t, err)
+
+	store := newDagStore(ctx, api, 1, false)
+
+	// The depth of a block is only known once its parent has been fetched.
+	_, err = store.Get(ctx, root)
+	assert.Nil(t, err)
+
+	parent, err := api.ResolvePath(ctx, ipath.Join(ipath.IpfsPath(root), "TestIPNSHostnameBacklinks"))
+	assert.Nil(t, err)
+	_, err = store.Get(ctx, parent.Cid())
+	assert.Nil(t, err)
+
+	_, err = store.Get(ctx, deep.Cid())
+	assert.True(t, errors.Is(err, ErrMaxTraversalDepth))
+}
+
+func TestPreferReturnMinimal(t *testing.T) {
+	for _, test := range []struct {
+		prefer   []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{"return=minimal"}, true},
+		{[]string{"return=representation"}, false},
+		{[]string{"wait=10, return=minimal"}, true},
+		{[]string{"respond-async", "return=minimal; foo=bar"}, true},
+		{[]string{"RETURN=MINIMAL"}, true},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/bafkqaaa", nil)
+		for _, v := range test.prefer {
+			r.Header.Add("Prefer", v)
+		}
+		assert.Equal(t, test.expected, preferReturnMinimal(r), "Prefer: %q", test.prefer)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	api, _ := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{MaxRequestBodyBytes: 16})
+	t.Logf("test server url: %s", ts.URL)
+
+	for _, test := range []struct {
+		body    string
+		chunked bool
+		status  int
+		close   bool
+	}{
+		{"", false, http.StatusMethodNotAllowed, false},
+		{"small body", false, http.StatusMethodNotAllowed, false},
+		{strings.Repeat("x", 17), false, http.StatusRequestEntityTooLarge, true},
+		// without a Content-Length the body is only found to be too large
+		// while reading it
+		{"small body", true, http.StatusMethodNotAllowed, false},
+		{strings.Repeat("x", 17), true, http.StatusMethodNotAllowed, true},
+	} {
+		var body io.Reader = strings.NewReader(test.body)
+		if test.chunked {
+			body = io.MultiReader(body)
+		}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/ipfs/bafkqaaa", body)
+		assert.Nil(t, err)
+
+		res, err := ts.Client().Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, test.status, res.StatusCode)
+		assert.Equal(t, test.close, res.Close, "connection closed after %d byte body", len(test.body))
+	}
+}
+
+func TestRequestBodyLimitNegative(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{MaxRequestBodyBytes: -1})
+	t.Logf("test server url: %s", ts.URL)
+
+	// An invalid limit falls back to the default instead of rejecting everything
+	res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+type panicMockAPI struct {
+	errorMockAPI
+}
+
+func (api *panicMockAPI) ResolvePath(ctx context.Context, ip ipath.Path) (ipath.Resolved, error) {
+	panic("the mock api panicked")
+}
+
+func TestPanicRecoveryReturnsInternalServerError(t *testing.T) {
+	ts := newTestServer(t, &panicMockAPI{})
+	t.Logf("test server url: %s", ts.URL)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/ipfs/bafkqaaa", nil)
+	assert.Nil(t, err)
+
+	res, err := ts.Client().Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+}
+
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadlines = append(r.deadlines, deadline)
+	return nil
+}
+
+func TestWriteTimeoutSetsDeadline(t *testing.T) {
+	before := time.Now()
+	rec := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &errRecordingResponseWriter{
+		ResponseWriter: &panicRecoveryResponseWriter{ResponseWriter: rec},
+		writeTimeout:   time.Minute,
+	}
+
+	_, err := w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = w.ReadFrom(strings.NewReader(" world"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "hello world", rec.Body.String())
+	assert.Equal(t, 2, len(rec.deadlines))
+	// Deadlines are set on the connection, so they follow the system clock
+	// even when Config.Clock is fixed
+	after := time.Now()
+	assert.False(t, rec.deadlines[0].Before(before.Add(time.Minute)))
+	assert.False(t, rec.deadlines[0].After(after.Add(time.Minute)))
+
+	// Without a timeout, deadlines are left alone
+	rec = &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w = &errRecordingResponseWriter{ResponseWriter: rec}
+	_, err = w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rec.deadlines))
+}
+
+func TestExpectContinue(t *testing.T) {
+	for _, test := range []struct {
+		reject  bool
+		initial int
+	}{
+		{false, http.StatusContinue},
+		{true, http.StatusExpectationFailed},
+	} {
+		api, root := newMockAPI(t)
+		ts := newTestServerWithConfig(t, api, Config{RejectExpectContinue: test.reject})
+		t.Logf("test server url: %s", ts.URL)
+
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		assert.Nil(t, err)
+		defer conn.Close()
+
+		_, err = fmt.Fprintf(conn, "GET /ipfs/%s/TestGatewayGet/fnord HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: 4\r\n\r\nbody", root, ts.Listener.Addr())
+		assert.Nil(t, err)
+
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, test.initial, res.StatusCode)
+		if test.reject {
+			continue
+		}
+
+		res, err = http.ReadResponse(br, nil)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(res.Body)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "fnord", string(body))
+	}
+}
+
+type corruptBlockAPI struct {
+	*mockAPI
+}
+
+func (api *corruptBlockAPI) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return blocks.NewBlockWithCid([]byte("corrupted"), c)
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	for _, test := range []struct {
+		verify bool
+		status int
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusBadGateway},
+	} {
+		api, root := newMockAPI(t)
+		ts := newTestServerWithConfig(t, &corruptBlockAPI{mockAPI: api}, Config{VerifyBlocks: test.verify})
+		t.Logf("test server url: %s", ts.URL)
+
+		res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord?format=raw")
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, test.status, res.StatusCode)
+	}
+
+	// Untampered blocks pass verification
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, api, Config{VerifyBlocks: true})
+	res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord?format=raw")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+type slowIPNSMockAPI struct {
+	*mockAPI
+}
+
+func (api *slowIPNSMockAPI) ResolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	if p.Namespace() == "ipns" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return api.mockAPI.ResolvePath(ctx, p)
+}
+
+func TestIPNSResolveTimeout(t *testing.T) {
+	api, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, &slowIPNSMockAPI{mockAPI: api}, Config{IPNSResolveTimeout: 50 * time.Millisecond})
+	t.Logf("test server url: %s", ts.URL)
+
+	res, err := ts.Client().Get(ts.URL + "/ipns/example.net")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+
+	// Immutable paths are not affected
+	res, err = ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+// slowBlockMockAPI never returns the blocks of slow.
+type slowBlockMockAPI struct {
+	*mockAPI
+	slow cid.Cid
+}
+
+func (api *slowBlockMockAPI) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if c == api.slow {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return api.mockAPI.GetBlock(ctx, c)
+}
+
+func TestFirstBlockTimeout(t *testing.T) {
+	api, root := newMockAPI(t)
+	slow := api.addTestDirectory(t, map[string]string{"a": "slow"})
+	ts := newTestServerWithConfig(t, &slowBlockMockAPI{mockAPI: api, slow: slow}, Config{FirstBlockTimeout: 50 * time.Millisecond})
+	t.Logf("test server url: %s", ts.URL)
+
+	// A bare CID resolves without its block, so the root block fetch times out
+	res, err := ts.Client().Get(ts.URL + "/ipfs/" + slow.String())
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode)
+
+	res, err = ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+// flakyBlockMockAPI fails the first fetches of every block.
+type flakyBlockMockAPI struct {
+	*mockAPI
+	failures int
+	err      error
+
+	mu      sync.Mutex
+	fetches map[cid.Cid]int
+}
+
+func (api *flakyBlockMockAPI) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	api.mu.Lock()
+	api.fetches[c]++
+	n := api.fetches[c]
+	api.mu.Unlock()
+	if n <= api.failures {
+		return nil, api.err
+	}
+	return api.mockAPI.GetBlock(ctx, c)
+}
+
+func TestBlockFetchRetry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		failures int
+		err      error
+		status   int
+		fetches  int
+	}{
+		// The root block is fetched once more to serve it after the retries
+		{"transient", 2, errors.New("connection reset"), http.StatusOK, 4},
+		{"persistent", 5, errors.New("connection reset"), http.StatusInternalServerError, 3},
+		{"not found", 5, ipld.ErrNotFound{}, http.StatusNotFound, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mock, root := newMockAPI(t)
+			api := &flakyBlockMockAPI{mockAPI: mock, failures: test.failures, err: test.err, fetches: map[cid.Cid]int{}}
+			ts := newTestServerWithConfig(t, api, Config{BlockFetchRetry: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}})
+
+			res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "?format=raw")
+			assert.Nil(t, err)
+			res.Body.Close()
+			assert.Equal(t, test.status, res.StatusCode)
+			assert.Equal(t, test.fetches, api.fetches[root])
+		})
+	}
+}
+
+// cacheTierMockAPI reports a miss for the first fetch of every block, and
+// memory hits afterwards.
+type cacheTierMockAPI struct {
+	*mockAPI
+	mu      sync.Mutex
+	fetched map[cid.Cid]bool
+}
+
+func (api *cacheTierMockAPI) GetBlockCacheTier(ctx context.Context, c cid.Cid) (blocks.Block, CacheTier, error) {
+	api.mu.Lock()
+	tier := CacheTierMiss
+	if api.fetched[c] {
+		tier = CacheTierMemory
+	}
+	api.fetched[c] = true
+	api.mu.Unlock()
+
+	blk, err := api.GetBlock(ctx, c)
+	return blk, tier, err
+}
+
+func TestCacheTierHeader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config Config
+	}{
+		{"default", Config{}},
+		{"with retries", Config{BlockFetchRetry: RetryPolicy{MaxAttempts: 3}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mock, root := newMockAPI(t)
+			api := &cacheTierMockAPI{mockAPI: mock, fetched: map[cid.Cid]bool{}}
+			ts := newTestServerWithConfig(t, api, test.config)
+
+			for _, want := range []string{"miss", "hit-memory"} {
+				res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "?format=raw")
+				assert.Nil(t, err)
+				res.Body.Close()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.Equal(t, want, res.Header.Get("X-Ipfs-Cache"))
+			}
+		})
+	}
+
+	mock, root := newMockAPI(t)
+	ts := newTestServerWithConfig(t, mock, Config{})
+	res, err := ts.Client().Get(ts.URL + "/ipfs/" + root.String() + "?format=raw")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, "", res.Header.Get("X-Ipfs-Cache"))
+}
+
+func TestMetricLabels(t *testing.T) {
+	h := newHandler(Config{
+		MetricLabels: []string{"tenant"},
+		MetricLabelsFunc: func(r *http.Request) prometheus.Labels {
+			return prometheus.Labels{"tenant": r.Host}
+		},
+	}, &panicMockAPI{})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/ipfs/bafkqaaa", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	panics := h.panicsMetric.With(prometheus.Labels{"gateway": "ipfs", "tenant": "example.org"})
+	assert.Equal(t, float64(1), promtest.ToFloat64(panics))
+}
+
+func TestOnlyIfCachedMetric(t *testing.T) {
+	api, root := newMockAPI(t)
+	h := newHandler(Config{}, api)
+
+	hits := h.onlyIfCachedMetric.With(prometheus.Labels{"gateway": "ipfs", "result": "hit"})
+	misses := h.onlyIfCachedMetric.With(prometheus.Labels{"gateway": "ipfs", "result": "miss"})
+	hitsBefore, missesBefore := promtest.ToFloat64(hits), promtest.ToFloat64(misses)
+
+	for _, p := range []string{
+		"/ipfs/" + root.String() + "/TestGatewayGet/fnord",
+		"/ipfs/bafkreifjjcie6lypi6ny7amxnfftagclbuxndqonfipmb64f2km2devei4",
+	} {
+		req := httptest.NewRequest(http.MethodHead, "http://example.org"+p, nil)
+		req.Header.Set("Cache-Control", "only-if-cached")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, hitsBefore+1, promtest.ToFloat64(hits))
+	assert.Equal(t, missesBefore+1, promtest.ToFloat64(misses))
+}
+
+func TestVerifyBlocksAbortsCAR(t *testing.T) {
+	api, root := newMockAPI(t)
+	file, err := api.ResolvePath(context.Background(), ipath.Join(ipath.IpfsPath(root), "TestGatewayGet", "fnord"))
+	assert.Nil(t, err)
+
+	for _, verify := range []bool{false, true} {
+		ts := newTestServerWithConfig(t, &corruptBlockAPI{mockAPI: api}, Config{VerifyBlocks: verify})
+		t.Logf("test server url: %s", ts.URL)
+
+		// A corrupt block must not look like a complete CAR stream: the
+		// connection is dropped, either before or while reading the body
+		res, err := ts.Client().Get(ts.URL + "/ipfs/" + file.Cid().String() + "?format=car")
+		if err == nil {
+			_, err = io.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		assert.Equal(t, verify, err != nil)
+	}
+}
+
+func TestContentDispositionHeader(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		expected string
+	}{
+		{"file.txt", `attachment; filename="file.txt"`},
+		{"my file+1.txt", `attachment; filename="my file+1.txt"`},
+		{`say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+		{"ünïcødé 1+1*'.txt", `attachment; filename="_n_c_d_ 1+1*'.txt"; filename*=UTF-8''%C3%BCn%C3%AFc%C3%B8d%C3%A9%201%2B1%2A%27.txt`},
+		{"evil\r\nSet-Cookie: a=b", `attachment; filename="evil__Set-Cookie: a=b"; filename*=UTF-8''evil%0D%0ASet-Cookie%3A%20a%3Db`},
+	} {
+		w := httptest.NewRecorder()
+		setContentDispositionHeader(w, test.filename, "attachment")
+		assert.Equal(t, test.expected, w.Header().Get("Content-Disposition"))
+	}
+}
+
+type blockingMockAPI struct {
+	*mockAPI
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (api *blockingMockAPI) ResolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	select {
+	case api.entered <- struct{}{}:
+	default:
+	}
+	<-api.release
+	return api.mockAPI.ResolvePath(ctx, p)
+}
+
+func TestDrain(t *testing.T) {
+	mock, root := newMockAPI(t)
+	api := &blockingMockAPI{mockAPI: mock, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	h := NewHandler(Config{}, api)
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	url := ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+	status := make(chan int)
+	go func() {
+		res, err := ts.Client().Get(url)
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-api.entered
+
+	// The in-flight request keeps Drain from returning
+	drainer := h.(Drainer)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, drainer.Drain(ctx))
+
+	// New requests are turned away while draining
+	res, err := ts.Client().Get(url)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, retryAfter, res.Header.Get("Retry-After"))
+
+	// Once it completes, Drain returns
+	close(api.release)
+	assert.Equal(t, http.StatusOK, <-status)
+	assert.Nil(t, drainer.Drain(context.Background()))
+}
+
+func TestExpandRedirectPlaceholders(t *testing.T) {
+	match := urlpath.Match{Params: map[string]string{"id": "1", "identifier": "2"}, Trailing: "a/b"}
+	for _, test := range []struct {
+		to       string
+		expected string
+	}{
+		{"/items/:id", "/items/1"},
+		{"/items/:identifier/:id", "/items/2/1"},
+		{"/files/:splat", "/files/a/b"},
+		{"/items/:unknown", "/items/:unknown"},
+		{"https://example.com:8080/:id?x=:id#:splat", "https://example.com:8080/1?x=1#a/b"},
+		{"/trailing:", "/trailing:"},
+	} {
+		assert.Equal(t, test.expected, expandRedirectPlaceholders(test.to, match), test.to)
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	for _, test := range []struct {
+		queueTimeout time.Duration
+		status       int
+	}{
+		{0, http.StatusServiceUnavailable},
+		{time.Minute, http.StatusOK},
+	} {
+		mock, root := newMockAPI(t)
+		api := &blockingMockAPI{mockAPI: mock, entered: make(chan struct{}, 1), release: make(chan struct{})}
+		h := newHandler(Config{MaxConcurrentRequests: 1, QueueTimeout: test.queueTimeout}, api)
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+
+		url := ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+		get := func(status chan<- int) {
+			res, err := ts.Client().Get(url)
+			if err != nil {
+				status <- 0
+				return
+			}
+			res.Body.Close()
+			status <- res.StatusCode
+		}
+		first, second := make(chan int), make(chan int)
+		go get(first)
+		<-api.entered
+		go get(second)
+
+		if test.queueTimeout == 0 {
+			// Without a queue, the second request is turned away right away
+			assert.Equal(t, test.status, <-second)
+			close(api.release)
+			assert.Equal(t, http.StatusOK, <-first)
+			continue
+		}
+
+		// Otherwise it waits in the queue until the first one is done
+		queued := h.requestsQueuedMetric.With(prometheus.Labels{"gateway": "ipfs"})
+		deadline := time.Now().Add(time.Second)
+		for promtest.ToFloat64(queued) < 1 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, float64(1), promtest.ToFloat64(queued))
+		close(api.release)
+		assert.Equal(t, http.StatusOK, <-first)
+		assert.Equal(t, test.status, <-second)
+	}
+}
+
+// recordingSpan is a no-op span that records the attributes, status and
+// errors set on it.
+type recordingSpan struct {
+	trace.Span
+	lk     sync.Mutex
+	attrs  []attribute.KeyValue
+	status codes.Code
+	errs   []error
+}
+
+func (s *recordingSpan) SetStatus(code codes.Code, _ string) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.status = code
+}
+
+func (s *recordingSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.errs = append(s.errs, err)
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.attrs = append(s.attrs, kv...)
+}
+
+func TestSpanStatus(t *testing.T) {
+	api, root := newMockAPI(t)
+	timeoutAPI := &errorMockAPI{err: fmt.Errorf("the mock api has timed out: %w", ErrGatewayTimeout)}
+
+	for _, test := range []struct {
+		api    API
+		path   string
+		status int
+		code   codes.Code
+		errors int
+	}{
+		{api, "/ipfs/" + root.String() + "/TestGatewayGet/fnord", http.StatusOK, codes.Unset, 0},
+		{api, "/ipfs/" + root.String() + "/missing", http.StatusNotFound, codes.Unset, 1},
+		{timeoutAPI, "/ipns/en.wikipedia-on-ipfs.org", http.StatusGatewayTimeout, codes.Error, 1},
+	} {
+		span := &recordingSpan{Span: trace.SpanFromContext(context.Background())}
+		req := httptest.NewRequest(http.MethodGet, "http://example.org"+test.path, nil)
+		req = req.WithContext(trace.ContextWithSpan(req.Context(), span))
+		rec := httptest.NewRecorder()
+		newHandler(Config{}, test.api).ServeHTTP(rec, req)
+
+		assert.Equal(t, test.status, rec.Code)
+		assert.Contains(t, span.attrs, attribute.Int("http.status_code", test.status))
+		assert.Equal(t, test.code, span.status)
+		assert.Equal(t, test.errors, len(span.errs))
+	}
+}
+
+func TestSpanAttributesFunc(t *testing.T) {
+	api, root := newMockAPI(t)
+	h := newHandler(Config{
+		SpanAttributesFunc: func(r *http.Request) []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("tenant", r.Host)}
+		},
+	}, api)
+
+	span := &recordingSpan{Span: trace.SpanFromContext(context.Background())}
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/ipfs/"+root.String()+"/TestGatewayGet/fnord", nil)
+	req = req.WithContext(trace.ContextWithSpan(req.Context(), span))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, span.attrs, attribute.String("tenant", "example.org"))
+}
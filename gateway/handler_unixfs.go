@@ -21,7 +21,7 @@ func (i *handler) serveUnixFS(ctx context.Context, w http.ResponseWriter, r *htt
 	dr, err := i.api.GetUnixFsNode(ctx, resolvedPath)
 	if err != nil {
 		err = fmt.Errorf("error while getting UnixFS node: %w", err)
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 	defer dr.Close()
@@ -35,7 +35,7 @@ func (i *handler) serveUnixFS(ctx context.Context, w http.ResponseWriter, r *htt
 	// Handling Unixfs directory
 	dir, ok := dr.(files.Directory)
 	if !ok {
-		webError(w, fmt.Errorf("unsupported UnixFS type"), http.StatusInternalServerError)
+		i.webError(w, fmt.Errorf("unsupported UnixFS type"), http.StatusInternalServerError)
 		return false
 	}
 
@@ -1,6 +1,7 @@
 package gateway
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	redirects "github.com/ipfs/go-ipfs-redirects-file"
 	"github.com/ipfs/go-libipfs/files"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/ucarion/urlpath"
 	"go.uber.org/zap"
 )
 
@@ -32,7 +34,9 @@ import (
 // Scenario 3:
 // Another possibility is that the path corresponds to a rewrite rule (i.e. a rule with a status of 200).
 // In this case, we don't perform a redirect, but do need to return a `path.Resolved` and `path.Path` corresponding to
-// the rewrite destination path.
+// the rewrite destination path. This is what makes the single-page app
+// catch-all `/* /index.html 200` work: any path that does not exist is served
+// with the content of index.html, without redirecting away from the requested URL.
 //
 // Note that for security reasons, redirect rules are only processed when the request has origin isolation.
 // See https://github.com/ipfs/specs/pull/290 for more information.
@@ -41,14 +45,14 @@ func (i *handler) serveRedirectsIfPresent(w http.ResponseWriter, r *http.Request
 	if redirectsFile != nil {
 		redirectRules, err := i.getRedirectRules(r, redirectsFile)
 		if err != nil {
-			webError(w, err, http.StatusInternalServerError)
+			i.webError(w, err, http.StatusInternalServerError)
 			return nil, nil, false, true
 		}
 
 		redirected, newPath, err := i.handleRedirectsFileRules(w, r, contentPath, redirectRules)
 		if err != nil {
 			err = fmt.Errorf("trouble processing _redirects file at %q: %w", redirectsFile.String(), err)
-			webError(w, err, http.StatusInternalServerError)
+			i.webError(w, err, http.StatusInternalServerError)
 			return nil, nil, false, true
 		}
 
@@ -62,7 +66,7 @@ func (i *handler) serveRedirectsIfPresent(w http.ResponseWriter, r *http.Request
 			contentPath = ipath.New(newPath)
 			resolvedPath, err = i.api.ResolvePath(r.Context(), contentPath)
 			if err != nil {
-				webError(w, err, http.StatusInternalServerError)
+				i.webError(w, err, http.StatusInternalServerError)
 				return nil, nil, false, true
 			}
 
@@ -84,31 +88,35 @@ func (i *handler) handleRedirectsFileRules(w http.ResponseWriter, r *http.Reques
 		urlPath = strings.TrimSuffix(urlPath, "/")
 
 		for _, rule := range redirectRules {
-			// Error right away if the rule is invalid
-			if !rule.MatchAndExpandPlaceholders(urlPath) {
+			fromPath := urlpath.New(strings.TrimSuffix(rule.From, "/"))
+			match, ok := fromPath.Match(urlPath)
+			if !ok {
 				continue
 			}
 
 			// We have a match!
+			to := expandRedirectPlaceholders(rule.To, match)
 
 			// Rewrite
 			if rule.Status == 200 {
 				// Prepend the rootPath
-				toPath := rootPath + rule.To
+				toPath := rootPath + redirectTargetPath(to)
 				return false, toPath, nil
 			}
 
 			// Or 4xx
 			if rule.Status == 404 || rule.Status == 410 || rule.Status == 451 {
-				toPath := rootPath + rule.To
+				toPath := rootPath + redirectTargetPath(to)
 				content4xxPath := ipath.New(toPath)
 				err := i.serve4xx(w, r, content4xxPath, rule.Status)
 				return true, toPath, err
 			}
 
-			// Or redirect
+			// Or redirect. Redirects are only processed with origin isolation,
+			// so a destination like /new is relative to the root of the
+			// DNSLink or subdomain site, not to the gateway.
 			if rule.Status >= 301 && rule.Status <= 308 {
-				http.Redirect(w, r, rule.To, rule.Status)
+				http.Redirect(w, r, to, rule.Status)
 				return true, "", nil
 			}
 		}
@@ -118,6 +126,50 @@ func (i *handler) handleRedirectsFileRules(w http.ResponseWriter, r *http.Reques
 	return false, "", nil
 }
 
+// expandRedirectPlaceholders substitutes the :placeholders and :splat of a
+// _redirects destination with the values matched in the source path. Only
+// whole placeholder names are replaced, so that :id does not clobber
+// :identifier, and names that were not matched are left as they are.
+func expandRedirectPlaceholders(to string, match urlpath.Match) string {
+	var b strings.Builder
+	for {
+		idx := strings.IndexByte(to, ':')
+		if idx < 0 {
+			b.WriteString(to)
+			return b.String()
+		}
+		b.WriteString(to[:idx])
+		to = to[idx+1:]
+
+		end := 0
+		for end < len(to) && isPlaceholderChar(to[end]) {
+			end++
+		}
+		name := to[:end]
+		to = to[end:]
+		if name == "splat" {
+			b.WriteString(match.Trailing)
+		} else if value, ok := match.Params[name]; ok && name != "" {
+			b.WriteString(value)
+		} else {
+			b.WriteString(":" + name)
+		}
+	}
+}
+
+func isPlaceholderChar(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// redirectTargetPath strips the query and fragment from a _redirects
+// destination, which only make sense to clients, not to path resolution.
+func redirectTargetPath(to string) string {
+	if idx := strings.IndexAny(to, "?#"); idx >= 0 {
+		return to[:idx]
+	}
+	return to
+}
+
 func (i *handler) getRedirectRules(r *http.Request, redirectsFilePath ipath.Resolved) ([]redirects.Rule, error) {
 	// Convert the path into a file node
 	node, err := i.api.GetUnixFsNode(r.Context(), redirectsFilePath)
@@ -132,12 +184,33 @@ func (i *handler) getRedirectRules(r *http.Request, redirectsFilePath ipath.Reso
 		return nil, fmt.Errorf("could not parse _redirects: %w", err)
 	}
 
+	// Don't read more than allowed, redirects.Parse enforces its own limit
+	var rd io.Reader = f
+	if maxSize := i.config.MaxRedirectsFileSize; maxSize > 0 {
+		buf, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("could not read _redirects: %w", err)
+		}
+		if int64(len(buf)) > maxSize {
+			return nil, fmt.Errorf("_redirects file size cannot exceed %d bytes", maxSize)
+		}
+		rd = bytes.NewReader(buf)
+	}
+
 	// Parse redirect rules from file
-	redirectRules, err := redirects.Parse(f)
+	redirectRules, err := redirects.Parse(rd)
 	if err != nil {
 		return nil, fmt.Errorf("could not parse _redirects: %w", err)
 	}
 
+	maxRules := i.config.MaxRedirectsRules
+	if maxRules == 0 {
+		maxRules = DefaultMaxRedirectsRules
+	}
+	if len(redirectRules) > maxRules {
+		return nil, fmt.Errorf("_redirects file cannot have more than %d rules, got %d", maxRules, len(redirectRules))
+	}
+
 	return redirectRules, nil
 }
 
@@ -189,7 +262,7 @@ func (i *handler) serve4xx(w http.ResponseWriter, r *http.Request, content4xxPat
 	log.Debugf("using _redirects: custom %d file at %q", status, content4xxPath)
 	w.Header().Set("Content-Type", "text/html")
 	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	addCacheControlHeaders(w, r, content4xxPath, resolved4xxPath.Cid())
+	i.addCacheControlHeaders(w, r, content4xxPath, resolved4xxPath.Cid())
 	w.WriteHeader(status)
 	_, err = io.CopyN(w, f, size)
 	return err
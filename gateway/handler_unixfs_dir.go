@@ -3,9 +3,12 @@ package gateway
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	gopath "path"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,15 +18,18 @@ import (
 	"github.com/ipfs/go-libipfs/gateway/assets"
 	path "github.com/ipfs/go-path"
 	"github.com/ipfs/go-path/resolver"
+	iface "github.com/ipfs/interface-go-ipfs-core"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/net/html"
 )
 
 // serveDirectory returns the best representation of UnixFS directory
 //
-// It will return index.html if present, or generate directory listing otherwise.
+// It will return the first of Config.IndexFileNames present, index.html by
+// default, or generate directory listing otherwise.
 func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path, dir files.Directory, begin time.Time, logger *zap.SugaredLogger) bool {
 	ctx, span := spanTrace(ctx, "ServeDirectory", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
 	defer span.End()
@@ -35,7 +41,7 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 	// the redirects and links would end up as http://example.net/ipns/example.net
 	requestURI, err := url.ParseRequestURI(r.RequestURI)
 	if err != nil {
-		webError(w, fmt.Errorf("failed to parse request path: %w", err), http.StatusInternalServerError)
+		i.webError(w, fmt.Errorf("failed to parse request path: %w", err), http.StatusInternalServerError)
 		return false
 	}
 	originalURLPath := requestURI.Path
@@ -53,41 +59,51 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 			}
 			// /ipfs/cid/foo?bar must be redirected to /ipfs/cid/foo/?bar
 			redirectURL := originalURLPath + suffix
-			logger.Debugw("directory location moved permanently", "status", http.StatusMovedPermanently)
-			http.Redirect(w, r, redirectURL, http.StatusMovedPermanently)
+			logger.Debugw("directory location moved permanently", "status", i.permanentRedirectCode())
+			http.Redirect(w, r, redirectURL, i.permanentRedirectCode())
 			return true
 		}
 	}
 
-	// Check if directory has index.html, if so, serveFile
-	idxPath := ipath.Join(contentPath, "index.html")
-	idxResolvedPath, err := i.api.ResolvePath(ctx, idxPath)
-	switch err.(type) {
-	case nil:
-		idx, err := i.api.GetUnixFsNode(ctx, idxResolvedPath)
-		if err != nil {
-			webError(w, err, http.StatusInternalServerError)
-			return false
-		}
+	// Check if directory has one of the index files, if so, serveFile the
+	// first one present
+	for _, indexName := range i.indexFileNames() {
+		idxPath := ipath.Join(contentPath, indexName)
+		idxResolvedPath, err := i.api.ResolvePath(ctx, idxPath)
+		switch err.(type) {
+		case nil:
+			idx, err := i.api.GetUnixFsNode(ctx, idxResolvedPath)
+			if err != nil {
+				i.webError(w, err, http.StatusInternalServerError)
+				return false
+			}
 
-		f, ok := idx.(files.File)
-		if !ok {
-			webError(w, files.ErrNotReader, http.StatusInternalServerError)
-			return false
-		}
+			f, ok := idx.(files.File)
+			if !ok {
+				i.webError(w, files.ErrNotReader, http.StatusInternalServerError)
+				return false
+			}
+
+			if i.config.IndexEarlyHints {
+				if err := sendIndexEarlyHints(w, f); err != nil {
+					i.webError(w, err, http.StatusInternalServerError)
+					return false
+				}
+			}
 
-		logger.Debugw("serving index.html file", "path", idxPath)
-		// write to request
-		success := i.serveFile(ctx, w, r, resolvedPath, idxPath, f, begin)
-		if success {
-			i.unixfsDirIndexGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+			logger.Debugw("serving index file", "path", idxPath)
+			// write to request
+			success := i.serveFile(ctx, w, r, resolvedPath, idxPath, f, begin)
+			if success {
+				i.unixfsDirIndexGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+			}
+			return success
+		case resolver.ErrNoLink:
+			logger.Debugw("no index file; noop", "path", idxPath)
+		default:
+			i.webError(w, err, http.StatusInternalServerError)
+			return false
 		}
-		return success
-	case resolver.ErrNoLink:
-		logger.Debugw("no index.html; noop", "path", idxPath)
-	default:
-		webError(w, err, http.StatusInternalServerError)
-		return false
 	}
 
 	// See statusResponseWriter.WriteHeader
@@ -95,8 +111,8 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 	// Note: this needs to occur before listingTemplate.Execute otherwise we get
 	// superfluous response.WriteHeader call from prometheus/client_golang
 	if w.Header().Get("Location") != "" {
-		logger.Debugw("location moved permanently", "status", http.StatusMovedPermanently)
-		w.WriteHeader(http.StatusMovedPermanently)
+		logger.Debugw("location moved permanently", "status", i.permanentRedirectCode())
+		w.WriteHeader(i.permanentRedirectCode())
 		return true
 	}
 
@@ -104,8 +120,13 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 	// type instead of relying on autodetection (which may fail).
 	w.Header().Set("Content-Type", "text/html")
 
+	lang := i.listingLanguage(r)
+	if len(i.config.ListingStrings) > 0 {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+
 	// Generated dir index requires custom Etag (output may change between go-ipfs versions)
-	dirEtag := getDirListingEtag(resolvedPath.Cid())
+	dirEtag := i.getDirListingEtag(resolvedPath.Cid(), lang)
 	w.Header().Set("Etag", dirEtag)
 
 	if r.Method == http.MethodHead {
@@ -115,17 +136,22 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 
 	results, err := i.api.LsUnixFsDir(ctx, resolvedPath)
 	if err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
-	dirListing := make([]assets.DirectoryItem, 0, len(results))
+	var links []iface.DirEntry
 	for link := range results {
 		if link.Err != nil {
-			webError(w, link.Err, http.StatusInternalServerError)
+			i.webError(w, link.Err, http.StatusInternalServerError)
 			return false
 		}
+		links = append(links, link)
+	}
+	sortDirEntries(links, i.config.DirSort)
 
+	dirListing := make([]assets.DirectoryItem, 0, len(links))
+	for _, link := range links {
 		hash := link.Cid.String()
 		di := assets.DirectoryItem{
 			Size:      humanize.Bytes(uint64(link.Size)),
@@ -193,20 +219,193 @@ func (i *handler) serveDirectory(ctx context.Context, w http.ResponseWriter, r *
 		Breadcrumbs: assets.Breadcrumbs(contentPath.String(), dnslink),
 		BackLink:    backLink,
 		Hash:        hash,
+		Lang:        lang,
+		Strings:     i.config.ListingStrings[lang],
 	}
 
 	logger.Debugw("request processed", "tplDataDNSLink", dnslink, "tplDataSize", size, "tplDataBackLink", backLink, "tplDataHash", hash)
 
 	if err := assets.DirectoryTemplate.Execute(w, tplData); err != nil {
-		webError(w, err, http.StatusInternalServerError)
+		i.webError(w, err, http.StatusInternalServerError)
 		return false
 	}
 
 	// Update metrics
-	i.unixfsGenDirListingGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+	i.unixfsGenDirListingGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 	return true
 }
 
-func getDirListingEtag(dirCid cid.Cid) string {
-	return `"DirIndex-` + assets.AssetHash + `_CID-` + dirCid.String() + `"`
+// sortDirEntries sorts the entries of a directory listing in the given order.
+func sortDirEntries(entries []iface.DirEntry, order DirSort) {
+	var less func(a, b iface.DirEntry) bool
+	switch order {
+	case DirSortName:
+		less = func(a, b iface.DirEntry) bool { return a.Name < b.Name }
+	case DirSortDirsFirst:
+		less = func(a, b iface.DirEntry) bool {
+			if aDir, bDir := a.Type == iface.TDirectory, b.Type == iface.TDirectory; aDir != bDir {
+				return aDir
+			}
+			return a.Name < b.Name
+		}
+	case DirSortSizeDesc:
+		less = func(a, b iface.DirEntry) bool {
+			if a.Size != b.Size {
+				return a.Size > b.Size
+			}
+			return a.Name < b.Name
+		}
+	default:
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+}
+
+// getDirListingEtag returns the Etag of the generated listing of dirCid in
+// lang. The listing also depends on the embedded template and on the
+// configured entry order, so both are part of it: changing either
+// invalidates cached listings.
+func (i *handler) getDirListingEtag(dirCid cid.Cid, lang string) string {
+	etag := `"DirIndex-` + assets.AssetHash + `_CID-` + dirCid.String()
+	if i.config.DirSort != DirSortName {
+		etag += "_Sort-" + strconv.Itoa(int(i.config.DirSort))
+	}
+	if lang != "en" {
+		etag += "_Lang-" + lang
+	}
+	return etag + `"`
+}
+
+// listingLanguage returns the language of Config.ListingStrings best
+// matching the Accept-Language header of r, trying each preferred language
+// and then its primary subtag, e.g. fr for fr-CA. It is "en" when none does.
+func (i *handler) listingLanguage(r *http.Request) string {
+	if len(i.config.ListingStrings) == 0 {
+		return "en"
+	}
+
+	type preference struct {
+		tag string
+		q   float64
+	}
+	var prefs []preference
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(a, b int) bool { return prefs[a].q > prefs[b].q })
+
+	for _, pref := range prefs {
+		primary, _, _ := strings.Cut(pref.tag, "-")
+		for _, tag := range []string{pref.tag, primary} {
+			for lang := range i.config.ListingStrings {
+				if strings.EqualFold(lang, tag) {
+					return lang
+				}
+			}
+		}
+	}
+	return "en"
+}
+
+const (
+	// maxIndexHeadBytes bounds how much of an index.html is parsed to find
+	// the subresources to preload
+	maxIndexHeadBytes = 64 << 10
+	// maxIndexPreloads bounds the number of Link headers sent with early hints
+	maxIndexPreloads = 16
+)
+
+// indexFileNames returns the names of the files served on behalf of a
+// directory, see Config.IndexFileNames.
+func (i *handler) indexFileNames() []string {
+	if i.config.IndexFileNames == nil {
+		return []string{"index.html"}
+	}
+	return i.config.IndexFileNames
+}
+
+// sendIndexEarlyHints sends a 103 Early Hints response with Link headers
+// preloading the subresources found in the <head> of index, and rewinds it.
+// Nothing is sent when there are none.
+func sendIndexEarlyHints(w http.ResponseWriter, index files.File) error {
+	links := indexPreloadLinks(io.LimitReader(index, maxIndexHeadBytes))
+	if _, err := index.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	for _, link := range links {
+		w.Header().Add("Link", link)
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	return nil
+}
+
+// indexPreloadLinks returns Link header values preloading the stylesheets and
+// scripts referenced in the <head> of the HTML document read from r. Only
+// relative URLs are kept: they resolve against the request URL the same way
+// in the header as in the document, unless a <base> element changes that, in
+// which case nothing is returned.
+func indexPreloadLinks(r io.Reader) []string {
+	var links []string
+	add := func(ref, rel, as string) {
+		u, err := url.Parse(ref)
+		if ref == "" || err != nil || u.Scheme != "" || u.Host != "" {
+			return
+		}
+		if len(links) < maxIndexPreloads {
+			links = append(links, fmt.Sprintf("<%s>; rel=%s; as=%s", u.String(), rel, as))
+		}
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return links
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				return links
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+			switch string(name) {
+			case "base":
+				return nil
+			case "body":
+				return links
+			case "link":
+				if strings.EqualFold(attrs["rel"], "stylesheet") {
+					add(attrs["href"], "preload", "style")
+				}
+			case "script":
+				if strings.EqualFold(attrs["type"], "module") {
+					add(attrs["src"], "modulepreload", "script")
+				} else {
+					add(attrs["src"], "preload", "script")
+				}
+			}
+		}
+	}
 }
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gabriel-vasile/mimetype"
+	cid "github.com/ipfs/go-cid"
 	"github.com/ipfs/go-libipfs/files"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
 	"go.opentelemetry.io/otel/attribute"
@@ -24,16 +25,18 @@ func (i *handler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.
 	defer span.End()
 
 	// Set Cache-Control and read optional Last-Modified time
-	modtime := addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
+	modtime := i.addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
 
 	// Set Content-Disposition
-	name := addContentDispositionHeader(w, r, contentPath)
+	name := i.addContentDispositionHeader(w, r, contentPath)
 
 	// Prepare size value for Content-Length HTTP header (set inside of http.ServeContent)
+	// This is the filesize declared by the UnixFS root node, which lets us
+	// send a strong Content-Length instead of streaming with chunked encoding.
 	size, err := file.Size()
 	if err != nil {
-		http.Error(w, "cannot serve files with unknown sizes", http.StatusBadGateway)
-		return false
+		// Without a size there is no Content-Length, nor range requests
+		return i.serveFileUnknownSize(w, r, contentPath, name, file, begin)
 	}
 
 	if size == 0 {
@@ -41,11 +44,17 @@ func (i *handler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.
 		// Also whatever you are asking for, it's cheaper to just give you the complete file (nothing).
 		// TODO: remove this if clause once https://github.com/golang/go/issues/54794 is fixed in two latest releases of go
 		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "0")
 		w.WriteHeader(http.StatusOK)
 		return true
 	}
 
-	// Lazy seeker enables efficient range-requests and HTTP HEAD responses
+	// Lazy seeker enables efficient range-requests, including multi-range
+	// ones answered with multipart/byteranges, and HTTP HEAD responses.
+	// It only seeks the UnixFS reader once data is read, and that reader
+	// seeks by descending the DAG using the block sizes recorded in its
+	// nodes, so a range deep in a large file only fetches the blocks on the
+	// way to it instead of every leaf before it.
 	content := &lazySeeker{
 		size:   size,
 		reader: file,
@@ -58,8 +67,21 @@ func (i *handler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.
 		// We should be smarter about resolving symlinks but this is the
 		// "most correct" we can be without doing that.
 		ctype = "inode/symlink"
+	} else if forced := i.forcedContentType(r); forced != "" {
+		ctype = forced
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 	} else {
-		ctype = mime.TypeByExtension(gopath.Ext(name))
+		if i.config.ContentTypeFunc != nil {
+			firstBytes, err := readFirstBytes(content)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("cannot detect content-type: %s", err.Error()), http.StatusInternalServerError)
+				return false
+			}
+			ctype = i.config.ContentTypeFunc(name, firstBytes)
+		}
+		if ctype == "" {
+			ctype = mime.TypeByExtension(gopath.Ext(name))
+		}
 		if ctype == "" {
 			// uses https://github.com/gabriel-vasile/mimetype library to determine the content type.
 			// Fixes https://github.com/ipfs/kubo/issues/7252
@@ -88,8 +110,13 @@ func (i *handler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.
 	// (unifies behavior across gateways and web browsers)
 	w.Header().Set("Content-Type", ctype)
 
+	if err := i.setFileReprDigest(w, resolvedPath, content); err != nil {
+		http.Error(w, fmt.Sprintf("cannot compute digest: %s", err.Error()), http.StatusInternalServerError)
+		return false
+	}
+
 	// special fixup around redirects
-	w = &statusResponseWriter{w}
+	w = &statusResponseWriter{ResponseWriter: w, redirectCode: i.permanentRedirectCode()}
 
 	// ServeContent will take care of
 	// If-None-Match+Etag, Content-Length and range requests
@@ -98,8 +125,110 @@ func (i *handler) serveFile(ctx context.Context, w http.ResponseWriter, r *http.
 	// Was response successful?
 	if dataSent {
 		// Update metrics
-		i.unixfsFileGetMetric.WithLabelValues(contentPath.Namespace()).Observe(time.Since(begin).Seconds())
+		i.unixfsFileGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
 	}
 
 	return dataSent
 }
+
+// setFileReprDigest sets the Repr-Digest header of a file. Files stored as a
+// single raw block have it in their CID, others are hashed, and rewound
+// after, when they are no larger than Config.ReprDigestMaxSize.
+func (i *handler) setFileReprDigest(w http.ResponseWriter, resolvedPath ipath.Resolved, content *lazySeeker) error {
+	if resolvedPath.Cid().Prefix().Codec == cid.Raw {
+		if digest, ok := cidReprDigest(resolvedPath.Cid()); ok {
+			w.Header().Set("Repr-Digest", digest)
+			return nil
+		}
+	}
+	if content.size > i.config.ReprDigestMaxSize {
+		return nil
+	}
+
+	digest, err := contentReprDigest(content)
+	if err != nil {
+		return err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.Header().Set("Repr-Digest", digest)
+	return nil
+}
+
+// forcedContentType returns the media type requested with the ?mime query
+// parameter, normalized, to be used instead of the sniffed Content-Type when
+// Config.AllowMimeOverride is set. Values that are not valid media types, or
+// are active content, are ignored.
+func (i *handler) forcedContentType(r *http.Request) string {
+	if !i.config.AllowMimeOverride {
+		return ""
+	}
+	v := r.URL.Query().Get("mime")
+	if v == "" {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil || !strings.Contains(mediaType, "/") || isActiveMediaType(mediaType) {
+		return ""
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// isActiveMediaType returns true for lowercase media types that browsers
+// render as documents able to run scripts, or run as scripts themselves.
+func isActiveMediaType(mediaType string) bool {
+	switch mediaType {
+	case "text/html", "text/xml", "application/xml", "text/xsl", "application/pdf", "multipart/x-mixed-replace":
+		return true
+	}
+	_, subtype, _ := strings.Cut(mediaType, "/")
+	// image/svg+xml, application/xhtml+xml, application/javascript,
+	// text/ecmascript and the like
+	return strings.HasSuffix(subtype, "+xml") || strings.Contains(subtype, "javascript") || strings.Contains(subtype, "ecmascript")
+}
+
+// serveFileUnknownSize streams a file whose size is not known upfront with
+// chunked transfer encoding.
+func (i *handler) serveFileUnknownSize(w http.ResponseWriter, r *http.Request, contentPath ipath.Path, name string, file files.File, begin time.Time) bool {
+	ctype := i.forcedContentType(r)
+	if ctype != "" {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else {
+		ctype = mime.TypeByExtension(gopath.Ext(name))
+	}
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	if _, err := io.Copy(w, file); err != nil {
+		log.Debugw("error streaming file of unknown size", "path", contentPath, "error", err)
+		return false
+	}
+	i.unixfsFileGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+	return true
+}
+
+// sniffLen is the number of leading bytes passed to Config.ContentTypeFunc,
+// the same amount http.DetectContentType considers.
+const sniffLen = 512
+
+// readFirstBytes returns up to sniffLen bytes from the start of content and
+// rewinds it.
+func readFirstBytes(content io.ReadSeeker) ([]byte, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
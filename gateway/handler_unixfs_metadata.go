@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	dag "github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfsnode/data"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	mc "github.com/multiformats/go-multicodec"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// unixfsMetadata is the response body of ?format=unixfs-metadata. Mode and
+// Mtime are only present when the node carries UnixFS 1.5 metadata.
+type unixfsMetadata struct {
+	Type  string     `json:"type"`
+	Size  *uint64    `json:"size,omitempty"`
+	Mode  *uint32    `json:"mode,omitempty"`
+	Mtime *time.Time `json:"mtime,omitempty"`
+}
+
+// serveUnixFSMetadata returns the attributes of the UnixFS node at
+// resolvedPath as JSON, without reading any of its content.
+func (i *handler) serveUnixFSMetadata(ctx context.Context, w http.ResponseWriter, r *http.Request, resolvedPath ipath.Resolved, contentPath ipath.Path, begin time.Time) bool {
+	ctx, span := spanTrace(ctx, "ServeUnixFSMetadata", trace.WithAttributes(attribute.String("path", resolvedPath.String())))
+	defer span.End()
+
+	blk, err := i.api.GetBlock(ctx, resolvedPath.Cid())
+	if err != nil {
+		err = fmt.Errorf("error getting block %s: %w", resolvedPath.Cid().String(), err)
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	dataType, size, ok := unixfsDataType(blk)
+	if !ok {
+		err := fmt.Errorf("%s is not a UnixFS node", debugStr(contentPath.String()))
+		webNotAcceptable(w, r, err)
+		return false
+	}
+	meta := unixfsMetadata{Type: dataType}
+	if dataType == "file" {
+		meta.Size = &size
+	}
+
+	if mc.Code(blk.Cid().Prefix().Codec) == mc.DagPb {
+		nd, err := dag.DecodeProtobuf(blk.RawData())
+		if err != nil {
+			i.webError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		fsData, err := data.DecodeUnixFSData(nd.Data())
+		if err != nil {
+			i.webError(w, err, http.StatusInternalServerError)
+			return false
+		}
+		if fsData.FieldMode().Exists() {
+			mode := uint32(fsData.FieldMode().Must().Int())
+			meta.Mode = &mode
+		}
+		if fsData.FieldMtime().Exists() {
+			mtime := fsData.FieldMtime().Must()
+			var nsecs int64
+			if mtime.FieldFractionalNanoseconds().Exists() {
+				nsecs = mtime.FieldFractionalNanoseconds().Must().Int()
+			}
+			t := time.Unix(mtime.FieldSeconds().Int(), nsecs).UTC()
+			meta.Mtime = &t
+		}
+	}
+
+	body, err := json.Marshal(meta)
+	if err != nil {
+		i.webError(w, err, http.StatusInternalServerError)
+		return false
+	}
+
+	i.addCacheControlHeaders(w, r, contentPath, resolvedPath.Cid())
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatch(inm, w.Header().Get("Etag"), "") {
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.ipfs.unixfs-metadata+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = w.Write(body)
+	if err == nil {
+		i.unixfsMetadataGetMetric.With(i.metricLabels(r, contentPath.Namespace())).Observe(i.since(begin).Seconds())
+	}
+	return err == nil
+}
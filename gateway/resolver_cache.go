@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// ResolverCache memoizes the results of API.ResolvePath. Implementations
+// decide for how long an entry stays valid, typically forever for immutable
+// /ipfs/ paths and for a bounded time for mutable ones such as /ipns/.
+type ResolverCache interface {
+	// Get returns the cached resolution of the path, if any.
+	Get(ipath.Path) (ipath.Resolved, bool)
+
+	// Add stores the resolution of the path.
+	Add(ipath.Path, ipath.Resolved)
+}
+
+// StaleResolverCache is a ResolverCache that can also return entries that
+// expired recently, for Config.StaleWhileRevalidate.
+type StaleResolverCache interface {
+	ResolverCache
+
+	// GetStale returns the cached resolution of the path like Get, and also
+	// the ones that expired less than maxStale ago, reporting them as stale.
+	GetStale(p ipath.Path, maxStale time.Duration) (resolved ipath.Resolved, stale bool, ok bool)
+}
+
+// AgingResolverCache is a ResolverCache that can tell how old its entries
+// are, for the Age header of responses for mutable paths.
+type AgingResolverCache interface {
+	ResolverCache
+
+	// Age returns how long ago the resolution of the path was added, if it
+	// is cached.
+	Age(ipath.Path) (time.Duration, bool)
+}
+
+// NewLRUResolverCache returns a ResolverCache that keeps up to size entries,
+// evicting the least recently used ones first. Entries for mutable paths
+// expire after ttl, entries for immutable paths only when evicted. Expiry is
+// measured with clock, which should usually be the handler's Config.Clock.
+// The system clock is used when nil. The returned cache is also a
+// StaleResolverCache and an AgingResolverCache.
+func NewLRUResolverCache(size int, ttl time.Duration, clock Clock) (ResolverCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &lruResolverCache{cache: cache, ttl: ttl, clock: clock}, nil
+}
+
+type lruResolverCache struct {
+	cache *lru.Cache
+	ttl   time.Duration
+	clock Clock
+}
+
+type resolverCacheEntry struct {
+	resolved ipath.Resolved
+	added    time.Time
+	expires  time.Time // zero for entries that never expire
+}
+
+func (c *lruResolverCache) Get(p ipath.Path) (ipath.Resolved, bool) {
+	v, ok := c.cache.Get(p.String())
+	if !ok {
+		return nil, false
+	}
+	entry := v.(resolverCacheEntry)
+	if !entry.expires.IsZero() && c.clock.Now().After(entry.expires) {
+		c.cache.Remove(p.String())
+		return nil, false
+	}
+	return entry.resolved, true
+}
+
+func (c *lruResolverCache) Add(p ipath.Path, resolved ipath.Resolved) {
+	now := c.clock.Now()
+	entry := resolverCacheEntry{resolved: resolved, added: now}
+	if p.Mutable() {
+		entry.expires = now.Add(c.ttl)
+	}
+	c.cache.Add(p.String(), entry)
+}
+
+func (c *lruResolverCache) GetStale(p ipath.Path, maxStale time.Duration) (ipath.Resolved, bool, bool) {
+	v, ok := c.cache.Get(p.String())
+	if !ok {
+		return nil, false, false
+	}
+	entry := v.(resolverCacheEntry)
+	if entry.expires.IsZero() {
+		return entry.resolved, false, true
+	}
+	now := c.clock.Now()
+	if !now.After(entry.expires) {
+		return entry.resolved, false, true
+	}
+	if now.After(entry.expires.Add(maxStale)) {
+		c.cache.Remove(p.String())
+		return nil, false, false
+	}
+	return entry.resolved, true, true
+}
+
+func (c *lruResolverCache) Age(p ipath.Path) (time.Duration, bool) {
+	v, ok := c.cache.Peek(p.String())
+	if !ok {
+		return 0, false
+	}
+	return c.clock.Now().Sub(v.(resolverCacheEntry).added), true
+}
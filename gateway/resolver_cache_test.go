@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	path "github.com/ipfs/go-path"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+func TestLRUResolverCacheExpiry(t *testing.T) {
+	clock := fixedClock(time.Now())
+	cache, err := NewLRUResolverCache(16, time.Minute, &clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, root := newMockAPI(t)
+	resolved := ipath.IpfsPath(root)
+	immutable := ipath.New("/ipfs/" + root.String())
+	mutable := ipath.New("/ipns/example.net")
+	cache.Add(immutable, resolved)
+	cache.Add(mutable, resolved)
+
+	if _, ok := cache.Get(mutable); !ok {
+		t.Fatal("expected mutable path to be cached")
+	}
+
+	clock = fixedClock(time.Time(clock).Add(2 * time.Minute))
+	if _, ok := cache.Get(mutable); ok {
+		t.Error("expected mutable path to expire after ttl")
+	}
+	if got, ok := cache.Get(immutable); !ok || got.Cid() != root {
+		t.Error("expected immutable path to stay cached")
+	}
+}
+
+func TestLRUResolverCacheGetStale(t *testing.T) {
+	clock := fixedClock(time.Now())
+	cache, err := NewLRUResolverCache(16, time.Minute, &clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleCache := cache.(StaleResolverCache)
+
+	_, root := newMockAPI(t)
+	mutable := ipath.New("/ipns/example.net")
+	cache.Add(mutable, ipath.IpfsPath(root))
+
+	if _, stale, ok := staleCache.GetStale(mutable, time.Minute); !ok || stale {
+		t.Fatalf("expected fresh entry, got stale=%t ok=%t", stale, ok)
+	}
+
+	clock = fixedClock(time.Time(clock).Add(90 * time.Second))
+	if got, stale, ok := staleCache.GetStale(mutable, time.Minute); !ok || !stale || got.Cid() != root {
+		t.Fatalf("expected stale entry within maxStale, got stale=%t ok=%t", stale, ok)
+	}
+
+	clock = fixedClock(time.Time(clock).Add(time.Minute))
+	if _, _, ok := staleCache.GetStale(mutable, time.Minute); ok {
+		t.Fatal("expected entry past maxStale to be dropped")
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	api, _ := newMockAPI(t)
+	rootA := api.addTestDirectory(t, map[string]string{"fnord": "old"})
+	rootB := api.addTestDirectory(t, map[string]string{"fnord": "new"})
+	api.namesys["/ipns/example.net"] = path.FromCid(rootA)
+
+	clock := fixedClock(time.Now())
+	cache, err := NewLRUResolverCache(16, time.Minute, &clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithConfig(t, api, Config{
+		ResolverCache:        cache,
+		StaleWhileRevalidate: time.Minute,
+	})
+
+	get := func() (string, *http.Response) {
+		t.Helper()
+		res, err := http.Get(ts.URL + "/ipns/example.net/fnord")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body), res
+	}
+
+	body, res := get()
+	if body != "old" {
+		t.Fatalf("expected original content, got %q", body)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "stale-while-revalidate=60" {
+		t.Errorf("expected stale-while-revalidate Cache-Control, got %q", got)
+	}
+
+	// the name moves on, and the cached resolution expires but is still
+	// within the stale window, so it is served while being resolved again
+	api.namesys["/ipns/example.net"] = path.FromCid(rootB)
+	clock = fixedClock(time.Time(clock).Add(90 * time.Second))
+	if body, _ := get(); body != "old" {
+		t.Fatalf("expected stale content, got %q", body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		body, _ := get()
+		if body == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected revalidated resolution to be served, still got %q", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolverCacheAgeHeader(t *testing.T) {
+	api, root := newMockAPI(t)
+	api.namesys["/ipns/example.net"] = path.FromCid(root)
+
+	clock := fixedClock(time.Now())
+	cache, err := NewLRUResolverCache(16, time.Minute, &clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithConfig(t, api, Config{ResolverCache: cache})
+
+	for _, test := range []struct {
+		path string
+		age  string
+	}{
+		// freshly resolved
+		{"/ipns/example.net/TestGatewayGet/fnord", ""},
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", ""},
+		// served from the cache 42 seconds later, immutable paths do not age
+		{"/ipns/example.net/TestGatewayGet/fnord", "42"},
+		{"/ipfs/" + root.String() + "/TestGatewayGet/fnord", ""},
+	} {
+		if test.age != "" {
+			clock = fixedClock(time.Time(clock).Add(42 * time.Second))
+		}
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Age"); got != test.age {
+			t.Errorf("%s: expected Age %q, got %q", test.path, test.age, got)
+		}
+	}
+}
+
+type countingResolveAPI struct {
+	*mockAPI
+	resolves int32
+}
+
+func (api *countingResolveAPI) ResolvePath(ctx context.Context, p ipath.Path) (ipath.Resolved, error) {
+	atomic.AddInt32(&api.resolves, 1)
+	return api.mockAPI.ResolvePath(ctx, p)
+}
+
+func TestResolverCacheAvoidsRepeatedResolution(t *testing.T) {
+	mock, root := newMockAPI(t)
+	api := &countingResolveAPI{mockAPI: mock}
+	cache, err := NewLRUResolverCache(16, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServerWithConfig(t, api, Config{ResolverCache: cache})
+
+	url := ts.URL + "/ipfs/" + root.String() + "/TestGatewayGet/fnord"
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
+		}
+	}
+
+	// content path plus the X-Ipfs-Roots segments, resolved only once
+	if n := atomic.LoadInt32(&api.resolves); n != 3 {
+		t.Errorf("expected 3 resolutions, got %d", n)
+	}
+}
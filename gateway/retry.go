@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-libipfs/blocks"
+	coreiface "github.com/ipfs/interface-go-ipfs-core"
+)
+
+// RetryPolicy describes how block fetches failing with transient errors are
+// retried, see Config.BlockFetchRetry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a block is fetched before giving
+	// up, including the first one. Below 2, nothing is retried.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry, doubled before each
+	// further one.
+	Backoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+}
+
+// retryingAPI is an API retrying GetBlock according to a RetryPolicy.
+type retryingAPI struct {
+	API
+	policy RetryPolicy
+}
+
+func (api *retryingAPI) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, _, err := api.retry(ctx, c, func(ctx context.Context, c cid.Cid) (blocks.Block, CacheTier, error) {
+		blk, err := api.API.GetBlock(ctx, c)
+		return blk, "", err
+	})
+	return blk, err
+}
+
+// GetBlockCacheTier retries the GetBlockCacheTier of the wrapped API, which
+// reports no cache tier when it is not a CacheTierAPI.
+func (api *retryingAPI) GetBlockCacheTier(ctx context.Context, c cid.Cid) (blocks.Block, CacheTier, error) {
+	tierAPI, ok := api.API.(CacheTierAPI)
+	if !ok {
+		blk, err := api.GetBlock(ctx, c)
+		return blk, "", err
+	}
+	return api.retry(ctx, c, tierAPI.GetBlockCacheTier)
+}
+
+func (api *retryingAPI) retry(ctx context.Context, c cid.Cid, fetch func(context.Context, cid.Cid) (blocks.Block, CacheTier, error)) (blocks.Block, CacheTier, error) {
+	backoff := api.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		blk, tier, err := fetch(ctx, c)
+		if err == nil || attempt >= api.policy.MaxAttempts || !retryableError(ctx, err) {
+			return blk, tier, err
+		}
+		log.Debugw("retrying block fetch", "cid", c, "attempt", attempt, "error", err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, "", err
+		case <-timer.C:
+		}
+		backoff *= 2
+		if maxBackoff := api.policy.MaxBackoff; maxBackoff > 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// retryableError returns true if fetching a block again may succeed where it
+// failed with err. Missing blocks stay missing, and nothing is retried once
+// the request is done.
+func retryableError(ctx context.Context, err error) bool {
+	switch {
+	case ctx.Err() != nil, isErrNotFound(err), errors.Is(err, coreiface.ErrOffline):
+		return false
+	case errors.Is(err, ErrGatewayTimeout), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,18 @@
+//go:build go1.20
+
+package gateway
+
+import (
+	"net/http"
+	"time"
+)
+
+const writeDeadlineSupported = true
+
+// setWriteDeadline sets the write deadline on the connection behind the
+// wrapped ResponseWriter, following Unwrap if needed.
+func (w *errRecordingResponseWriter) setWriteDeadline(deadline time.Time) {
+	if err := http.NewResponseController(w.ResponseWriter).SetWriteDeadline(deadline); err != nil {
+		log.Debugw("failed to set write deadline", "error", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !go1.20
+
+package gateway
+
+import "time"
+
+// Before Go 1.20, http.ResponseWriter offers no way to set write deadlines.
+const writeDeadlineSupported = false
+
+func (w *errRecordingResponseWriter) setWriteDeadline(deadline time.Time) {}